@@ -0,0 +1,268 @@
+// Package client implements a Go client for the wire-directory RPC server.
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// connected is the HTTP status returned by net/rpc when switching protocols
+const connected = "200 Connected to Go RPC"
+
+// Service method names of server.RPC
+const (
+	findMethod       = "RPC.Find"
+	findDeviceMethod = "RPC.FindDevice"
+	announceMethod   = "RPC.Announce"
+	whoAmIMethod     = "RPC.WhoAmI"
+	gossipMethod     = "RPC.Gossip"
+	challengeMethod  = "RPC.Challenge"
+	authMethod       = "RPC.Authenticate"
+)
+
+// ErrUnexpectedStatus is returned by Dial when the server
+// does not accept the RPC connection.
+var ErrUnexpectedStatus = errors.New("unexpected HTTP response")
+
+// ErrRecordAge is returned by Verify for endpoints observed longer than the maximum age ago.
+var ErrRecordAge = errors.New("record older than maximum age")
+
+// Client for a directory server.
+// It is safe for concurrent use.
+type Client struct {
+	addr string
+	rpc  *rpc.Client
+}
+
+// Dial connects to the directory server listening on addr (host:port).
+// The context only bounds the connection setup;
+// the returned Client stays usable after ctx is done.
+func Dial(ctx context.Context, addr string) (*Client, error) {
+	return DialToken(ctx, addr, "")
+}
+
+// DialToken is like Dial, with the session token of Authenticate.
+// All calls of the returned Client are made as the authenticated peer,
+// until the session expires. No token is sent when token is empty.
+func DialToken(ctx context.Context, addr string, token string) (*Client, error) {
+	if strings.ContainsAny(token, "\r\n") {
+		return nil, fmt.Errorf("dial %s: invalid token", addr)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	if err = connect(ctx, conn, token); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+	return &Client{
+		addr: addr,
+		rpc:  rpc.NewClient(conn),
+	}, nil
+}
+
+// connect performs the HTTP CONNECT handshake of net/rpc on conn,
+// with token in the Authorization header if not empty.
+// Deadline of ctx, if any, is applied to the handshake.
+func connect(ctx context.Context, conn net.Conn, token string) error {
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	stop, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			// Unblock the pending read or write
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-exited
+		conn.SetDeadline(time.Time{})
+	}()
+
+	rq := "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n"
+	if token != "" {
+		rq += "Authorization: Bearer " + token + "\n"
+	}
+	if _, err := io.WriteString(conn, rq+"\n"); err != nil {
+		return ctxErr(ctx, err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return ctxErr(ctx, err)
+	}
+	if resp.Status != connected {
+		return fmt.Errorf("%w: %s", ErrUnexpectedStatus, resp.Status)
+	}
+	return nil
+}
+
+// aLongTimeAgo is a deadline in the past, used to interrupt blocking I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// ctxErr returns the context error if ctx is done, err otherwise.
+// This reports a cancellation instead of the I/O timeout it caused.
+// The connection deadline may expire just before ctx does.
+func ctxErr(ctx context.Context, err error) error {
+	if ce := ctx.Err(); ce != nil {
+		return ce
+	}
+	if dl, ok := ctx.Deadline(); ok && !time.Now().Before(dl) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// Addr returns the address the Client is connected to.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// Find peers by their public keys.
+// When ctx is done before the server responds, ctx.Err() is returned.
+func (c *Client) Find(ctx context.Context, keys []wgtypes.Key) (server.PeerMap, error) {
+	var pm server.PeerMap
+	if err := c.call(ctx, findMethod, keys, &pm); err != nil {
+		return server.PeerMap{}, fmt.Errorf("find on %s: %w", c.addr, err)
+	}
+	return pm, nil
+}
+
+// FindDevice finds peers by their public keys on a WireGuard device of the server,
+// which may serve several devices. The device of the listener is used when device is empty.
+// When ctx is done before the server responds, ctx.Err() is returned.
+func (c *Client) FindDevice(ctx context.Context, device string, keys []wgtypes.Key) (server.PeerMap, error) {
+	return c.Lookup(ctx, server.FindRequest{Device: device, Keys: keys})
+}
+
+// Lookup finds the peers of rq, with its options like a device or the maximum age
+// of the returned endpoints, see server.RPC.FindDevice.
+// When ctx is done before the server responds, ctx.Err() is returned.
+func (c *Client) Lookup(ctx context.Context, rq server.FindRequest) (server.PeerMap, error) {
+	var pm server.PeerMap
+	if err := c.call(ctx, findDeviceMethod, rq, &pm); err != nil {
+		return server.PeerMap{}, fmt.Errorf("find on %s: %w", c.addr, err)
+	}
+	return pm, nil
+}
+
+// Verify the endpoints in pm against trust, so that answers relayed by
+// directories which are not trusted themselves can be used.
+// The Endpoint of a found peer is removed when its Record is not signed by a directory in trust,
+// see server.Peer.Verify, or when maxAge is positive and the signed observation is older than maxAge.
+// Candidates are announced by the peers themselves and are never signed,
+// they are always removed. Peers left without endpoint get Status NoEndpoint.
+// The returned error joins the verification errors of the removed endpoints.
+func Verify(pm *server.PeerMap, trust server.TrustList, maxAge time.Duration) error {
+	var errs []error
+	for k, p := range pm.Peers {
+		if p.Status != server.Found {
+			continue
+		}
+		p.Candidates, p.Announced = nil, time.Time{}
+		if p.Endpoint != nil {
+			err := p.Verify(trust)
+			if err == nil && maxAge > 0 && time.Since(p.Record.Observed) > maxAge {
+				err = fmt.Errorf("%w: observed %s", ErrRecordAge, p.Record.Observed)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", k, err))
+				p.Endpoint, p.Record = nil, nil
+			}
+		}
+		if p.Endpoint == nil {
+			p.Status = server.NoEndpoint
+		}
+		pm.Peers[k] = p
+	}
+	return errors.Join(errs...)
+}
+
+// Announce candidate endpoints of the local peer to the directory.
+// The directory identifies the local peer by its access control,
+// which needs to be enabled on the server.
+// The returned TTL is the time the directory serves the announcement.
+func (c *Client) Announce(ctx context.Context, endpoints []*net.UDPAddr) (ttl time.Duration, err error) {
+	var rs server.AnnounceReply
+	if err = c.call(ctx, announceMethod, server.Announcement{Endpoints: endpoints}, &rs); err != nil {
+		return 0, fmt.Errorf("announce on %s: %w", c.addr, err)
+	}
+	return rs.TTL, nil
+}
+
+// WhoAmI returns how the directory observes the local peer:
+// its WireGuard endpoint and the remote address of the RPC connection.
+func (c *Client) WhoAmI(ctx context.Context) (server.Reflection, error) {
+	var rs server.Reflection
+	if err := c.call(ctx, whoAmIMethod, struct{}{}, &rs); err != nil {
+		return server.Reflection{}, fmt.Errorf("whoami on %s: %w", c.addr, err)
+	}
+	return rs, nil
+}
+
+// Gossip sends records to the directory and returns the records of the directory.
+// Gossip and access control need to be enabled on the server.
+func (c *Client) Gossip(ctx context.Context, records []server.Record) ([]server.Record, error) {
+	var rs []server.Record
+	if err := c.call(ctx, gossipMethod, records, &rs); err != nil {
+		return nil, fmt.Errorf("gossip on %s: %w", c.addr, err)
+	}
+	return rs, nil
+}
+
+// Authenticate the connection as the peer with the private key priv,
+// by answering a challenge of the server, see server.RPC.Challenge.
+// The following calls on c are made as that peer.
+// The returned Session authenticates new connections with DialToken
+// and requests to the JSON APIs, until it expires.
+func (c *Client) Authenticate(ctx context.Context, priv wgtypes.Key) (server.Session, error) {
+	var ch server.Challenge
+	if err := c.call(ctx, challengeMethod, server.ChallengeRequest{PublicKey: priv.PublicKey()}, &ch); err != nil {
+		return server.Session{}, fmt.Errorf("authenticate on %s: %w", c.addr, err)
+	}
+	proof, err := ch.Prove(priv)
+	if err != nil {
+		return server.Session{}, fmt.Errorf("authenticate on %s: %w", c.addr, err)
+	}
+	var s server.Session
+	if err = c.call(ctx, authMethod, server.AuthRequest{Nonce: ch.Nonce, Proof: proof}, &s); err != nil {
+		return server.Session{}, fmt.Errorf("authenticate on %s: %w", c.addr, err)
+	}
+	return s, nil
+}
+
+// call method on the server and wait for the reply or ctx to be done
+func (c *Client) call(ctx context.Context, method string, args interface{}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	call := c.rpc.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-call.Done:
+		return call.Error
+	}
+}
+
+// Close the connection to the server.
+func (c *Client) Close() error {
+	return c.rpc.Close()
+}
@@ -0,0 +1,356 @@
+// +build unit
+
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func testServer(t *testing.T, device string) *httptest.Server {
+	rs, err := server.NewRPC(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(rs)
+}
+
+func TestClient_Find(t *testing.T) {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := k.PublicKey()
+	ep := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 123}
+	m := server.NewMemoryBackend()
+	m.SetPeers("wgtest", wgtypes.Peer{PublicKey: key, Endpoint: ep})
+	rs, err := server.NewRPCBackend("wgtest", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(rs)
+	defer ts.Close()
+
+	c, err := Dial(context.Background(), ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := c.Find(context.Background(), []wgtypes.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[wgtypes.Key]server.Peer{
+		key: {Status: server.Found, PublicKey: key, Endpoint: ep},
+	}
+	if !reflect.DeepEqual(got.Peers, want) {
+		t.Errorf("Client.Find() = %v, want %v", got.Peers, want)
+	}
+}
+
+func TestClient_FindDevice(t *testing.T) {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := k.PublicKey()
+	m := server.NewMemoryBackend()
+	m.SetPeers("wgtest", wgtypes.Peer{PublicKey: key})
+	rs, err := server.NewRPCBackend("wgtest", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(rs)
+	defer ts.Close()
+
+	c, err := Dial(context.Background(), ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := c.FindDevice(context.Background(), "wgtest", []wgtypes.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Peers[key].Status != server.NoEndpoint {
+		t.Errorf("Client.FindDevice() = %v, want %v", got.Peers[key], server.NoEndpoint)
+	}
+	_, err = c.FindDevice(context.Background(), "wgother", []wgtypes.Key{key})
+	if err == nil || !strings.Contains(err.Error(), server.ErrUnknownDevice.Error()) {
+		t.Errorf("Client.FindDevice() error = %v, want %v", err, server.ErrUnknownDevice)
+	}
+	_, err = c.Lookup(context.Background(), server.FindRequest{Keys: []wgtypes.Key{key}, MaxAge: -time.Minute})
+	if err == nil || !strings.Contains(err.Error(), server.ErrNegativeMaxAge.Error()) {
+		t.Errorf("Client.Lookup() error = %v, want %v", err, server.ErrNegativeMaxAge)
+	}
+}
+
+func TestClient_Authenticate(t *testing.T) {
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := priv.PublicKey()
+	m := server.NewMemoryBackend()
+	m.SetPeers("wgtest", wgtypes.Peer{PublicKey: key})
+	srv, err := server.Configure("wgtest", 0, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Backend = m
+	srv.Auth = &server.Auth{Required: true}
+	go srv.ListenAndServe()
+	defer srv.Close()
+	var addr string
+	for deadline := time.Now().Add(5 * time.Second); addr == ""; time.Sleep(10 * time.Millisecond) {
+		if ls := srv.Listeners(); len(ls) == 1 && ls[0].Bound != nil {
+			addr = ls[0].Bound.String()
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("listener not serving")
+		}
+	}
+
+	c, err := Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Find(context.Background(), []wgtypes.Key{key}); err == nil {
+		t.Error("Client.Find() expected error before authentication")
+	}
+	s, err := c.Authenticate(context.Background(), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Find(context.Background(), []wgtypes.Key{key}); err != nil {
+		t.Errorf("Client.Find() error = %v after authentication", err)
+	}
+
+	c2, err := DialToken(context.Background(), addr, s.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	r, err := c2.WhoAmI(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.PublicKey != key {
+		t.Errorf("Client.WhoAmI() = %v, want %v", r.PublicKey, key)
+	}
+}
+
+func TestDial(t *testing.T) {
+	ts := testServer(t, "foo")
+	defer ts.Close()
+	notRPC := httptest.NewServer(http.NotFoundHandler())
+	defer notRPC.Close()
+	// Accepts connections, but never answers
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	tests := []struct {
+		name    string
+		addr    string
+		timeout time.Duration
+		wantErr error
+	}{
+		{
+			name:    "rpc server",
+			addr:    ts.Listener.Addr().String(),
+			timeout: time.Second,
+		},
+		{
+			name:    "not a rpc server",
+			addr:    notRPC.Listener.Addr().String(),
+			timeout: time.Second,
+			wantErr: ErrUnexpectedStatus,
+		},
+		{
+			name:    "timeout",
+			addr:    silent.Addr().String(),
+			timeout: 10 * time.Millisecond,
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			got, err := Dial(ctx, tt.addr)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer got.Close()
+			if got.Addr() != tt.addr {
+				t.Errorf("Dial() Addr = %v, want %v", got.Addr(), tt.addr)
+			}
+		})
+	}
+}
+
+// In unit testing, we test only the error
+func TestClient_error_Find(t *testing.T) {
+	ts := testServer(t, "foo")
+	defer ts.Close()
+	c, err := Dial(context.Background(), ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		keys    []wgtypes.Key
+		wantErr string
+	}{
+		{
+			name:    "bogus device",
+			ctx:     context.Background(),
+			keys:    []wgtypes.Key{{}},
+			wantErr: "find on " + c.Addr(),
+		},
+		{
+			name:    "canceled",
+			ctx:     canceled,
+			wantErr: context.Canceled.Error(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := c.Find(tt.ctx, tt.keys)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Client.Find() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// The test server has no access control, so it can not identify the announcing peer
+func TestClient_error_Announce(t *testing.T) {
+	ts := testServer(t, "foo")
+	defer ts.Close()
+	c, err := Dial(context.Background(), ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	endpoints := []*net.UDPAddr{{IP: net.ParseIP("192.168.0.1"), Port: 51820}}
+	if _, err = c.Announce(context.Background(), endpoints); err == nil || !strings.Contains(err.Error(), server.ErrNoCaller.Error()) {
+		t.Errorf("Client.Announce() error = %v, want %v", err, server.ErrNoCaller)
+	}
+}
+
+// fakeDirectory implements the WhoAmI method of a directory server
+type fakeDirectory struct {
+	rs server.Reflection
+}
+
+func (d *fakeDirectory) WhoAmI(rq struct{}, rs *server.Reflection) error {
+	*rs = d.rs
+	return nil
+}
+
+func TestClient_WhoAmI(t *testing.T) {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := server.Reflection{
+		Known:      true,
+		PublicKey:  k.PublicKey(),
+		Endpoint:   &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 51820},
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234},
+	}
+	rs := rpc.NewServer()
+	if err = rs.RegisterName("RPC", &fakeDirectory{want}); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(rs)
+	defer ts.Close()
+
+	c, err := Dial(context.Background(), ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := c.WhoAmI(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Client.WhoAmI() = %v, want %v", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	var keys []wgtypes.Key
+	for i := 0; i < 6; i++ {
+		k, err := wgtypes.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, k)
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ep := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 51820}
+	now := time.Now()
+	r := server.Record{PublicKey: keys[0], Endpoint: ep, Observed: now, Observer: keys[3]}
+	r.Sign(priv)
+	old := server.Record{PublicKey: keys[4], Endpoint: ep, Observed: now.Add(-2 * time.Hour), Observer: keys[3]}
+	old.Sign(priv)
+	replayed := server.Record{PublicKey: keys[5], Endpoint: ep, Observed: now.Add(-2 * time.Hour), Observer: keys[3]}
+	replayed.Sign(priv)
+	pm := server.PeerMap{Peers: map[wgtypes.Key]server.Peer{
+		keys[0]: {Status: server.Found, PublicKey: keys[0], Endpoint: ep, LastHandshakeTime: now, Record: &r},
+		// Endpoint without record
+		keys[1]: {Status: server.Found, PublicKey: keys[1], Endpoint: ep, LastHandshakeTime: now},
+		// Unsigned candidates
+		keys[2]: {Status: server.Found, PublicKey: keys[2], Candidates: []*net.UDPAddr{ep}, Announced: now},
+		// Signed, but observed before the max age
+		keys[4]: {Status: server.Found, PublicKey: keys[4], Endpoint: ep, LastHandshakeTime: old.Observed, Record: &old},
+		// Old record, claimed to be observed now
+		keys[5]: {Status: server.Found, PublicKey: keys[5], Endpoint: ep, LastHandshakeTime: now, Record: &replayed},
+	}}
+	err = Verify(&pm, server.TrustList{keys[3]: pub}, time.Hour)
+	for _, want := range []error{server.ErrUnsigned, ErrRecordAge, server.ErrBadSignature} {
+		if !errors.Is(err, want) {
+			t.Errorf("Verify() error = %v, want %v", err, want)
+		}
+	}
+	want := map[wgtypes.Key]server.Peer{
+		keys[0]: {Status: server.Found, PublicKey: keys[0], Endpoint: ep, LastHandshakeTime: now, Record: &r},
+		keys[1]: {Status: server.NoEndpoint, PublicKey: keys[1], LastHandshakeTime: now},
+		keys[2]: {Status: server.NoEndpoint, PublicKey: keys[2]},
+		keys[4]: {Status: server.NoEndpoint, PublicKey: keys[4], LastHandshakeTime: old.Observed},
+		keys[5]: {Status: server.NoEndpoint, PublicKey: keys[5], LastHandshakeTime: now},
+	}
+	if !reflect.DeepEqual(pm.Peers, want) {
+		t.Errorf("Verify() peers = \n%v\n, want \n%v\n", pm.Peers, want)
+	}
+}
@@ -0,0 +1,401 @@
+// Command wire-directory runs the directory RPC server for WireGuard devices.
+//
+// Usage:
+//
+//	wire-directory -device wg0 -port 9000 [-addr 10.0.0.1 -addr fd00::1] [-grace 10s] [-repair 30s] [-stale 3m]
+//	wire-directory -device wg0,wg1 -port 9000
+//	wire-directory -device '*' -port 9000
+//	wire-directory -config /etc/wire-directory.toml
+//
+// With -config, the configuration is loaded from a TOML file, see package config,
+// and all other flags are ignored.
+//
+// Without -addr, the server listens on all addresses of each device
+// and follows the address changes, also when the device is created after the start.
+// Requests are answered for the device of the address they are made on.
+// With -device '*', all WireGuard devices are served and discovered while running.
+// Repair and gossip run for the devices present at the start.
+// Every -repair interval, the endpoints of peers without a handshake during -stale
+// are looked up on the directory servers of reachable peers, listening on the same port.
+// Use -repair 0 to disable.
+//
+// A listener that fails is dropped while the other listeners keep serving,
+// and is started again on the next address change of the device.
+// With -retry, it is retried with exponential backoff starting at the given delay instead.
+// With -addr and without -retry, a failing listener stops the server.
+//
+// With -acl, -allow or -deny, only callers connecting to an address of the device
+// from a single host allowed IP of a device peer are answered.
+// -acl-networks also accepts allowed IPs that are networks, but never default routes.
+// With -auth, callers can instead prove the possession of a peer's private key
+// with a challenge-response handshake, which yields a session token.
+// -auth-required only answers authenticated callers.
+// With -auth, the repair, announce and gossip loops authenticate with the private key of the device,
+// so all directories need -auth as well.
+// With -announce, the local addresses and -endpoint values are announced
+// as endpoint candidates to the directories of reachable peers,
+// which need to have access control enabled.
+// -reflect adds the endpoints of this node, as observed by those directories.
+//
+// With -gossip, endpoint records are exchanged with the directories of -fanout random
+// reachable peers every interval and Find answers from the merged view.
+// Gossip is only accepted from peers, so access control needs to be enabled on all nodes.
+//
+// Prometheus metrics are served on /metrics of every listener,
+// peers without a handshake during -stale are reported as stale.
+//
+// /healthz and /readyz report if a listener is serving and the device is readable,
+// with the status only: the errors are logged at debug level.
+// Under systemd with Type=notify, readiness is reported once a listener is serving,
+// or right away when the device has no addresses yet. A configured WatchdogSec
+// is only kept alive while both checks pass.
+//
+// Events are logged to stderr, in the -log-format text or json, from -log-level on.
+// RPC calls are logged at the info level, lookups at debug.
+//
+// On SIGINT or SIGTERM the server is shut down gracefully,
+// open connections are forcefully closed after the grace period.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/usrpro/wire-directory/config"
+	"github.com/usrpro/wire-directory/gossip"
+	"github.com/usrpro/wire-directory/repair"
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// stringList collects repeated flags
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+var (
+	defaults = config.Default()
+
+	file   = flag.String("config", "", "Configuration file, other flags are ignored when set")
+	device = flag.String("device", "wg0", "WireGuard devices to serve, comma separated, or * for all devices")
+	port   = flag.Uint("port", 9000, "TCP port to listen on")
+	grace  = flag.Duration("grace", defaults.ShutdownGrace.Duration, "Graceful shutdown period")
+	rint   = flag.Duration("repair", defaults.Repair.Interval.Duration, "Endpoint repair interval, 0 disables repair")
+	stale  = flag.Duration("stale", defaults.Repair.Stale.Duration, "Handshake age after which a peer's endpoint is repaired")
+	maxAge = flag.Duration("max-age", 0, "Maximum age of the endpoints used for repair, 0 uses all")
+	share  = flag.Bool("share-allowed-ips", false, "Disclose the allowed IPs of peers to directory clients")
+	acl    = flag.Bool("acl", false, "Only answer callers that are peers of the device")
+	aclNet = flag.Bool("acl-networks", false, "Also identify peers by allowed IPs that are networks (implies -acl)")
+	auth   = flag.Bool("auth", false, "Accept the authentication of callers by their WireGuard key")
+	authr  = flag.Bool("auth-required", false, "Only answer authenticated callers (implies -auth)")
+	anno   = flag.Bool("announce", false, "Announce local addresses as endpoint candidates to the directories of reachable peers")
+	refl   = flag.Bool("reflect", false, "Announce the endpoints observed by the directories of reachable peers")
+	gint   = flag.Duration("gossip", 0, "Gossip interval for endpoint records, 0 disables gossip")
+	retry  = flag.Duration("retry", 0, "Initial delay to retry failed listeners, 0 disables retries (a failed -addr listener then stops the server)")
+	fanout = flag.Int("fanout", defaults.Gossip.Fanout, "Number of peers to gossip with in each interval")
+	lfmt   = flag.String("log-format", "text", "Log format, text or json")
+	sign   = flag.String("signing-key", "", "PEM encoded Ed25519 key file to sign the observed endpoint records with")
+	policy = flag.String("policy", "", "Visibility policy file of which peers may find each other, reloaded on SIGHUP")
+	lvl    slog.Level
+	addrs  stringList
+	allow  stringList
+	deny   stringList
+	priv   stringList
+	trust  stringList
+	eps    stringList
+)
+
+func init() {
+	flag.TextVar(&lvl, "log-level", slog.LevelInfo, "Minimal level of logged events: debug, info, warn or error")
+	flag.Var(&addrs, "addr", "IP address to listen on, may be repeated (default: all addresses of device)")
+	flag.Var(&allow, "allow", "Public key of a peer allowed access, may be repeated (implies -acl)")
+	flag.Var(&deny, "deny", "Public key of a peer denied access, may be repeated (implies -acl)")
+	flag.Var(&trust, "trust", "Directory whose signed endpoint records are trusted, as <WireGuard key>:<Ed25519 key>, may be repeated")
+	flag.Var(&priv, "private", "Public key of a peer which endpoint is never disclosed, may be repeated")
+	flag.Var(&eps, "endpoint", "Additional endpoint candidate (host:port) to announce, for example a public or port-mapped address. May be repeated (implies -announce)")
+}
+
+func main() {
+	flag.Parse()
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(c); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadConfig from the -config file, or from the other flags
+func loadConfig() (*config.Config, error) {
+	if *file != "" {
+		return config.Load(*file)
+	}
+	c := defaults
+	c.ShutdownGrace.Duration = *grace
+	names := strings.Split(*device, ",")
+	if len(names) > 1 && addrs != nil {
+		return nil, errors.New("-addr requires a single -device")
+	}
+	c.Devices = nil
+	for _, name := range names {
+		c.Devices = append(c.Devices, config.Device{
+			Name:      strings.TrimSpace(name),
+			Port:      int(*port),
+			Addresses: addrs,
+		})
+	}
+	c.ShareAllowedIPs = *share
+	c.PrivatePeers = priv
+	if *retry > 0 {
+		c.Retry = &config.Retry{
+			Delay: config.Duration{Duration: *retry},
+		}
+	}
+	if *auth || *authr {
+		c.Auth = &config.Auth{
+			Required: *authr,
+		}
+	}
+	if *acl || *aclNet || allow != nil || deny != nil {
+		c.ACL = &config.ACL{
+			Allow:    allow,
+			Deny:     deny,
+			Networks: *aclNet,
+		}
+	}
+	c.Repair.Interval.Duration = *rint
+	c.Repair.Stale.Duration = *stale
+	c.Repair.MaxAge.Duration = *maxAge
+	c.Repair.Announce = *anno || eps != nil
+	c.Repair.Reflect = *refl
+	c.Repair.Endpoints = eps
+	c.Gossip.Interval.Duration = *gint
+	c.Gossip.Fanout = *fanout
+	c.Log.Format = *lfmt
+	c.Log.Level = lvl
+	c.PolicyFile = *policy
+	c.Signing.KeyFile = *sign
+	for _, t := range trust {
+		wg, ed, ok := strings.Cut(t, ":")
+		if !ok {
+			return nil, fmt.Errorf("-trust %s: want <WireGuard key>:<Ed25519 key>", t)
+		}
+		if c.Signing.Trust == nil {
+			c.Signing.Trust = make(map[string]string)
+		}
+		c.Signing.Trust[wg] = ed
+	}
+	return c, c.Validate()
+}
+
+func run(c *config.Config) error {
+	var w io.Writer = os.Stderr
+	if c.Log.File != "" {
+		f, err := os.OpenFile(c.Log.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	slog.SetDefault(slog.New(c.Log.Handler(w)))
+	srv, err := c.Server()
+	if err != nil {
+		return err
+	}
+
+	ec := make(chan error, 1)
+	go func() {
+		ec <- srv.ListenAndServe()
+	}()
+	if c.Repair.Interval.Duration > 0 {
+		stop, err := startRepair(c)
+		if err != nil {
+			srv.Close()
+			return err
+		}
+		defer stop()
+	}
+	if c.Gossip.Interval.Duration > 0 {
+		stop, err := startGossip(c, srv)
+		if err != nil {
+			srv.Close()
+			return err
+		}
+		defer stop()
+	}
+	defer notifyReady(srv)()
+	defer startWatchdog(srv)()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+wait:
+	for {
+		select {
+		case err = <-ec:
+			return err
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				reloadPolicy(c, srv)
+				continue
+			}
+			slog.Info("shutting down", "signal", s.String())
+			break wait
+		}
+	}
+	notify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownGrace.Duration)
+	defer cancel()
+	if err = srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	if err = <-ec; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// reloadPolicy loads the policy file again and replaces the policy of srv.
+// On error, the current policy is kept.
+func reloadPolicy(c *config.Config, srv *server.Server) {
+	if c.PolicyFile == "" {
+		return
+	}
+	p, err := config.LoadPolicy(c.PolicyFile)
+	if err != nil {
+		slog.Error("policy reload failed", "file", c.PolicyFile, "error", err)
+		return
+	}
+	srv.SetPolicy(p)
+	slog.Info("policy reloaded", "file", c.PolicyFile)
+}
+
+// startRepair runs the endpoint repair loop in the background,
+// until the returned stop function is called.
+func startRepair(c *config.Config) (stop func(), err error) {
+	wgc, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	ds, err := devices(c, wgc)
+	if err != nil {
+		wgc.Close()
+		return nil, err
+	}
+	var fns []func(context.Context) error
+	for _, d := range ds {
+		r := repair.New(wgc, d.Name, uint16(d.Port))
+		r.Interval = c.Repair.Interval.Duration
+		r.Threshold = c.Repair.Stale.Duration
+		r.Timeout = c.Repair.Timeout.Duration
+		r.MaxAge = c.Repair.MaxAge.Duration
+		r.AnnounceReflected = c.Repair.Reflect
+		r.Trust = c.Signing.TrustList()
+		r.Authenticate = c.Auth != nil
+		if c.Repair.Announce {
+			eps := c.Endpoints()
+			r.Candidates = func(dev *wgtypes.Device) ([]*net.UDPAddr, error) {
+				local, err := repair.LocalCandidates(dev)
+				if err != nil {
+					return nil, err
+				}
+				return append(eps[:len(eps):len(eps)], local...), nil
+			}
+		}
+		fns = append(fns, r.Run)
+	}
+	return background(wgc, fns...), nil
+}
+
+// startGossip exchanges endpoint records with other directories in the background,
+// until the returned stop function is called.
+func startGossip(c *config.Config, srv *server.Server) (stop func(), err error) {
+	wgc, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	ds, err := devices(c, wgc)
+	if err != nil {
+		wgc.Close()
+		return nil, err
+	}
+	var fns []func(context.Context) error
+	for _, d := range ds {
+		g := gossip.New(srv, wgc, d.Name, uint16(d.Port))
+		g.Interval = c.Gossip.Interval.Duration
+		g.Fanout = c.Gossip.Fanout
+		g.Threshold = c.Repair.Stale.Duration
+		g.Authenticate = c.Auth != nil
+		fns = append(fns, g.Run)
+	}
+	return background(wgc, fns...), nil
+}
+
+// devices returns the configured devices for the background loops.
+// config.AllDevices is replaced by the WireGuard devices present at the start.
+func devices(c *config.Config, wgc *wgctrl.Client) ([]config.Device, error) {
+	named := make(map[string]bool)
+	for _, d := range c.Devices {
+		named[d.Name] = true
+	}
+	var ds []config.Device
+	for _, d := range c.Devices {
+		if d.Name != config.AllDevices {
+			ds = append(ds, d)
+			continue
+		}
+		devs, err := wgc.Devices()
+		if err != nil {
+			return nil, err
+		}
+		for _, dev := range devs {
+			if !named[dev.Name] {
+				ds = append(ds, config.Device{Name: dev.Name, Port: d.Port})
+			}
+		}
+	}
+	return ds, nil
+}
+
+// background runs fns until the returned stop function is called,
+// which closes wgc after all fns returned.
+func background(wgc *wgctrl.Client, fns ...func(context.Context) error) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for _, fn := range fns {
+		wg.Add(1)
+		go func(fn func(context.Context) error) {
+			defer wg.Done()
+			fn(ctx)
+		}(fn)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+		wgc.Close()
+	}
+}
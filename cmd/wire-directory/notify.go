@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/usrpro/wire-directory/server"
+)
+
+// notify sends state to the service manager, see sd_notify(3).
+// It does nothing when NOTIFY_SOCKET is not set.
+func notify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// readyInterval is the interval at which the health of the server is polled before READY=1
+const readyInterval = 50 * time.Millisecond
+
+// notifyReady sends READY=1 once srv is healthy, see server.Server.Healthy:
+// a listener is serving, or the device to follow has no addresses yet.
+// Nothing is sent when the returned stop function is called before.
+// It does nothing when NOTIFY_SOCKET is not set.
+func notifyReady(srv *server.Server) (stop func()) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return func() {}
+	}
+	t := time.NewTicker(readyInterval)
+	done := make(chan struct{})
+	go func() {
+		defer t.Stop()
+		for srv.Healthy() != nil {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+		}
+		if err := notify("READY=1"); err != nil {
+			slog.Warn("notify ready failed", "error", err)
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
+// watchdogInterval returns the interval to send WATCHDOG=1 at,
+// half of WATCHDOG_USEC. Zero when the watchdog is not enabled for this process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// startWatchdog keeps the service manager's watchdog alive while srv is healthy and ready,
+// until the returned stop function is called.
+// Stop is a no-op when the watchdog is not enabled.
+func startWatchdog(srv *server.Server) (stop func()) {
+	interval := watchdogInterval()
+	if interval == 0 {
+		return func() {}
+	}
+	t := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		var last string
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			err := srv.Healthy()
+			if err == nil {
+				err = srv.Ready()
+			}
+			if err != nil {
+				if err.Error() != last {
+					slog.Warn("watchdog check failed", "error", err)
+					last = err.Error()
+				}
+				continue
+			}
+			last = ""
+			if err = notify("WATCHDOG=1"); err != nil {
+				slog.Warn("notify watchdog failed", "error", err)
+			}
+		}
+	}()
+	return func() {
+		t.Stop()
+		close(done)
+	}
+}
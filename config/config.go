@@ -0,0 +1,486 @@
+// Package config loads the configuration of a directory server from a TOML file.
+//
+// Example:
+//
+//	shutdown_grace = "10s"
+//	policy_file = "/etc/wire-directory-policy.toml"  # see Policy
+//	share_allowed_ips = false
+//	private_peers = ["xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="]  # endpoints never disclosed
+//	announce_ttl = "10m"
+//	read_header_timeout = "5s"
+//	idle_timeout = "2m"
+//
+//	[[device]]
+//	name = "wg0"  # "*" serves all WireGuard devices
+//	port = 9000
+//	addresses = ["10.0.0.1", "fd00::1"]  # default: all addresses of the device
+//
+//	[[device]]  # more devices
+//	name = "wg1"
+//	port = 9001
+//
+//	[acl]  # enables access control
+//	allow = ["fjCs9/W9VrlzkdcuqaJgZFolrLIMDX3KtYmHoxMotl4="]
+//	deny = []
+//	networks = false  # also identify peers by allowed IPs that are networks
+//
+//	[auth]  # enables authentication by WireGuard key
+//	session_ttl = "10m"
+//	required = false  # also reject callers identified by their address
+//
+//	[retry]  # retries failed listeners with backoff
+//	delay = "1s"
+//	max_delay = "1m"
+//	attempts = 0  # unlimited
+//
+//	[repair]
+//	interval = "30s"  # "0s" disables
+//	stale = "3m"
+//	timeout = "5s"
+//	max_age = "10m"  # ignore older endpoints, "0s" uses all
+//	announce = true
+//	reflect = true
+//	endpoints = ["203.0.113.1:51820"]
+//
+//	[gossip]
+//	interval = "30s"  # "0s" disables
+//	fanout = 3
+//
+//	[signing]
+//	key_file = "/etc/wire-directory/signing.pem"  # signs the observed endpoint records
+//
+//	[signing.trust]  # directories which records are trusted, by WireGuard key
+//	"xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=" = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+//
+//	[log]
+//	file = "/var/log/wire-directory.log"  # default: stderr
+//	format = "json"  # or "text"
+//	level = "info"  # debug, info, warn or error
+package config
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/usrpro/wire-directory/gossip"
+	"github.com/usrpro/wire-directory/repair"
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Duration is a time.Duration which is decoded from a string, like "10s"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) (err error) {
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Config of a directory server
+type Config struct {
+	// ShutdownGrace is the graceful shutdown period of the daemon
+	ShutdownGrace Duration `toml:"shutdown_grace"`
+	Devices       []Device `toml:"device"`
+	Repair        Repair   `toml:"repair"`
+	Gossip        Gossip   `toml:"gossip"`
+	Log           Log      `toml:"log"`
+	Signing       Signing  `toml:"signing"`
+	// PolicyFile is the path of a visibility policy, see Policy.
+	// The daemon reloads it on SIGHUP.
+	PolicyFile      string `toml:"policy_file"`
+	ShareAllowedIPs bool   `toml:"share_allowed_ips"`
+	// PrivatePeers are the public keys of peers which endpoints are never disclosed,
+	// see server.Disclosure
+	PrivatePeers      []string `toml:"private_peers"`
+	AnnounceTTL       Duration `toml:"announce_ttl"`
+	ReadHeaderTimeout Duration `toml:"read_header_timeout"`
+	IdleTimeout       Duration `toml:"idle_timeout"`
+	// ACL enables access control when present
+	ACL *ACL `toml:"acl"`
+	// Retry of failed listeners when present
+	Retry *Retry `toml:"retry"`
+	// Auth enables authentication when present
+	Auth *Auth `toml:"auth"`
+}
+
+// AllDevices is the device name serving all WireGuard devices of the system,
+// see server.ConfigureAll
+const AllDevices = "*"
+
+// Device is the configuration of a served WireGuard device.
+// The other settings of Config apply to all devices.
+type Device struct {
+	// Name of the device, or AllDevices
+	Name string `toml:"name"`
+	Port int    `toml:"port"`
+	// Addresses to listen on, all addresses of the device when empty
+	Addresses []string `toml:"addresses"`
+}
+
+// ACL is the configuration of access control, see server.ACL
+type ACL struct {
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+	// Networks also identifies callers by allowed IPs which are networks
+	Networks bool `toml:"networks"`
+}
+
+// Auth is the configuration of authentication, see server.Auth.
+// When present, the repair and gossip loops of the daemon authenticate as well.
+type Auth struct {
+	SessionTTL Duration `toml:"session_ttl"`
+	// Required rejects callers which did not authenticate.
+	Required bool `toml:"required"`
+}
+
+// Retry is the configuration of listener retries, see server.Retry
+type Retry struct {
+	Delay    Duration `toml:"delay"`
+	MaxDelay Duration `toml:"max_delay"`
+	Attempts int      `toml:"attempts"`
+}
+
+// Repair is the configuration of the endpoint repair loop, see repair.Repairer
+type Repair struct {
+	// Interval between repair passes, 0 disables repair
+	Interval Duration `toml:"interval"`
+	Stale    Duration `toml:"stale"`
+	Timeout  Duration `toml:"timeout"`
+	// MaxAge of the endpoints looked up on directories, 0 uses all, see repair.Repairer
+	MaxAge Duration `toml:"max_age"`
+	// Announce the local addresses as endpoint candidates
+	Announce bool `toml:"announce"`
+	// Reflect announces the endpoints observed by other directories
+	Reflect bool `toml:"reflect"`
+	// Endpoints are additional candidates to announce
+	Endpoints []string `toml:"endpoints"`
+}
+
+// Gossip is the configuration of endpoint gossip, see gossip.Gossiper
+type Gossip struct {
+	// Interval between gossip rounds, 0 disables gossip
+	Interval Duration `toml:"interval"`
+	Fanout   int      `toml:"fanout"`
+}
+
+// Log is the logging configuration
+type Log struct {
+	// File to append log output to, stderr when empty
+	File string `toml:"file"`
+	// Format is "text" (default) or "json"
+	Format string `toml:"format"`
+	// Level is the minimal level of logged events, info when empty
+	Level slog.Level `toml:"level"`
+}
+
+// Handler returns a slog.Handler writing to w, in the configured Format and Level
+func (l *Log) Handler(w io.Writer) slog.Handler {
+	opts := &slog.HandlerOptions{Level: l.Level}
+	if l.Format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// Default configuration, used for the values absent in a configuration file
+func Default() *Config {
+	return &Config{
+		ShutdownGrace: Duration{10 * time.Second},
+		Repair: Repair{
+			Interval: Duration{repair.DefaultInterval},
+			Stale:    Duration{repair.DefaultThreshold},
+			Timeout:  Duration{repair.DefaultTimeout},
+		},
+		Gossip: Gossip{
+			Fanout: gossip.DefaultFanout,
+		},
+	}
+}
+
+// Error is a validation error of a configuration key
+type Error struct {
+	// Key path, like "device[0].port"
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("config: %s: %v", e.Key, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// keyErr returns an *Error for key, with a formatted message
+func keyErr(key string, format string, a ...interface{}) error {
+	return &Error{Key: key, Err: fmt.Errorf(format, a...)}
+}
+
+// Load and validate the configuration file at path
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Parse and validate a TOML configuration.
+// Unknown keys are reported as an error.
+func Parse(r io.Reader) (*Config, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	c := Default()
+	md, err := toml.Decode(string(data), c)
+	if err != nil {
+		return nil, err
+	}
+	if ud := md.Undecoded(); len(ud) > 0 {
+		keys := make([]string, len(ud))
+		for i, k := range ud {
+			keys[i] = k.String()
+		}
+		sort.Strings(keys)
+		return nil, keyErr(keys[0], "unknown key")
+	}
+	if err = c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Validate the configuration. The returned error is an *Error,
+// pointing at the offending key.
+func (c *Config) Validate() error {
+	if c.ShutdownGrace.Duration < 0 {
+		return keyErr("shutdown_grace", "negative duration")
+	}
+	if len(c.Devices) == 0 {
+		return keyErr("device", "at least one device required")
+	}
+	names := make(map[string]bool, len(c.Devices))
+	for i, d := range c.Devices {
+		key := fmt.Sprintf("device[%d]", i)
+		if err := d.validate(key); err != nil {
+			return err
+		}
+		if names[d.Name] {
+			return keyErr(key+".name", "duplicate device %q", d.Name)
+		}
+		names[d.Name] = true
+		if i > 0 && d.Name == AllDevices {
+			return keyErr(key+".name", "%q is only supported on device[0]", AllDevices)
+		}
+	}
+	for _, v := range []struct {
+		key string
+		d   Duration
+	}{
+		{"announce_ttl", c.AnnounceTTL},
+		{"read_header_timeout", c.ReadHeaderTimeout},
+		{"idle_timeout", c.IdleTimeout},
+	} {
+		if v.d.Duration < 0 {
+			return keyErr(v.key, "negative duration")
+		}
+	}
+	if r := c.Retry; r != nil {
+		if r.Delay.Duration < 0 {
+			return keyErr("retry.delay", "negative duration")
+		}
+		if r.MaxDelay.Duration < 0 {
+			return keyErr("retry.max_delay", "negative duration")
+		}
+		if r.Attempts < 0 {
+			return keyErr("retry.attempts", "negative number")
+		}
+	}
+	if a := c.Auth; a != nil && a.SessionTTL.Duration < 0 {
+		return keyErr("auth.session_ttl", "negative duration")
+	}
+	if _, err := parseKeys("private_peers", c.PrivatePeers); err != nil {
+		return err
+	}
+	if c.ACL != nil {
+		if _, err := parseKeys("acl.allow", c.ACL.Allow); err != nil {
+			return err
+		}
+		if _, err := parseKeys("acl.deny", c.ACL.Deny); err != nil {
+			return err
+		}
+	}
+	if err := c.Repair.validate("repair"); err != nil {
+		return err
+	}
+	if c.Gossip.Interval.Duration < 0 {
+		return keyErr("gossip.interval", "negative duration")
+	}
+	if c.Gossip.Interval.Duration > 0 && c.Gossip.Fanout < 1 {
+		return keyErr("gossip.fanout", "must be at least 1")
+	}
+	if err := c.Signing.validate("signing"); err != nil {
+		return err
+	}
+	switch c.Log.Format {
+	case "", "text", "json":
+	default:
+		return keyErr("log.format", "must be text or json, got %q", c.Log.Format)
+	}
+	return nil
+}
+
+func (d *Device) validate(key string) error {
+	if d.Name == "" {
+		return keyErr(key+".name", "required")
+	}
+	if d.Port < 1 || d.Port > 65535 {
+		return keyErr(key+".port", "must be between 1 and 65535, got %d", d.Port)
+	}
+	if d.Name == AllDevices && len(d.Addresses) > 0 {
+		return keyErr(key+".addresses", "not supported for all devices")
+	}
+	for i, a := range d.Addresses {
+		if net.ParseIP(a) == nil {
+			return keyErr(fmt.Sprintf("%s.addresses[%d]", key, i), "Invalid IP address: %s", a)
+		}
+	}
+	return nil
+}
+
+func (r *Repair) validate(key string) error {
+	if r.Interval.Duration < 0 {
+		return keyErr(key+".interval", "negative duration")
+	}
+	if r.Stale.Duration <= 0 {
+		return keyErr(key+".stale", "must be positive")
+	}
+	if r.MaxAge.Duration < 0 {
+		return keyErr(key+".max_age", "negative duration")
+	}
+	if r.Timeout.Duration <= 0 {
+		return keyErr(key+".timeout", "must be positive")
+	}
+	_, err := r.endpoints(key + ".endpoints")
+	return err
+}
+
+// parseKeys parses base64 encoded keys, errors point at key[i]
+func parseKeys(key string, ss []string) ([]wgtypes.Key, error) {
+	var keys []wgtypes.Key
+	for i, s := range ss {
+		k, err := wgtypes.ParseKey(strings.TrimSpace(s))
+		if err != nil {
+			return nil, &Error{Key: fmt.Sprintf("%s[%d]", key, i), Err: err}
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// endpoints parses the configured Endpoints, errors point at key[i]
+func (r *Repair) endpoints(key string) ([]*net.UDPAddr, error) {
+	var eps []*net.UDPAddr
+	for i, s := range r.Endpoints {
+		ep, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			return nil, &Error{Key: fmt.Sprintf("%s[%d]", key, i), Err: err}
+		}
+		eps = append(eps, ep)
+	}
+	return eps, nil
+}
+
+// Server configures a *server.Server serving all devices.
+func (c *Config) Server() (*server.Server, error) {
+	d := c.Devices[0]
+	var (
+		srv *server.Server
+		err error
+	)
+	if d.Name == AllDevices {
+		srv = server.ConfigureAll(uint16(d.Port))
+	} else if srv, err = server.Configure(d.Name, uint16(d.Port), d.Addresses...); err != nil {
+		return nil, err
+	}
+	for _, o := range c.Devices[1:] {
+		if err = srv.AddDevice(o.Name, uint16(o.Port), o.Addresses...); err != nil {
+			return nil, err
+		}
+	}
+	srv.Disclosure.AllowedIPs = c.ShareAllowedIPs
+	// Keys are validated by Validate
+	srv.Disclosure.Private, _ = parseKeys("", c.PrivatePeers)
+	srv.AnnounceTTL = c.AnnounceTTL.Duration
+	srv.ReadHeaderTimeout = c.ReadHeaderTimeout.Duration
+	srv.IdleTimeout = c.IdleTimeout.Duration
+	srv.Gossip = c.Gossip.Interval.Duration > 0
+	srv.StaleThreshold = c.Repair.Stale.Duration
+	if r := c.Retry; r != nil {
+		srv.Retry = &server.Retry{
+			Delay:    r.Delay.Duration,
+			MaxDelay: r.MaxDelay.Duration,
+			Attempts: r.Attempts,
+		}
+	}
+	if a := c.Auth; a != nil {
+		srv.Auth = &server.Auth{
+			SessionTTL: a.SessionTTL.Duration,
+			Required:   a.Required,
+		}
+	}
+	if c.ACL != nil {
+		// Keys are validated by Validate
+		allow, _ := parseKeys("", c.ACL.Allow)
+		deny, _ := parseKeys("", c.ACL.Deny)
+		srv.ACL = &server.ACL{
+			Allow:    allow,
+			Deny:     deny,
+			Networks: c.ACL.Networks,
+		}
+	}
+	if c.Signing.KeyFile != "" {
+		if srv.SigningKey, err = LoadSigningKey(c.Signing.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	srv.Trust = c.Signing.TrustList()
+	if c.PolicyFile != "" {
+		p, err := LoadPolicy(c.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+		srv.SetPolicy(p)
+	}
+	return srv, nil
+}
+
+// Endpoints returns the additional endpoint candidates of Repair.
+// They are validated by Validate.
+func (c *Config) Endpoints() []*net.UDPAddr {
+	eps, _ := c.Repair.endpoints("")
+	return eps
+}
@@ -0,0 +1,230 @@
+// +build unit
+
+package config
+
+import (
+	"errors"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+shutdown_grace = "5s"
+announce_ttl = "1m"
+
+[[device]]
+name = "wg0"
+port = 9000
+addresses = ["10.0.0.1", "fd00::1"]
+
+[[device]]
+name = "wg1"
+port = 9001
+
+[acl]
+allow = ["fjCs9/W9VrlzkdcuqaJgZFolrLIMDX3KtYmHoxMotl4="]
+
+[retry]
+delay = "2s"
+
+[auth]
+session_ttl = "5m"
+
+[repair]
+interval = "0s"
+endpoints = ["203.0.113.1:51820"]
+
+[gossip]
+interval = "1m"
+
+[log]
+file = "/tmp/wire-directory.log"
+format = "json"
+level = "debug"
+`
+
+func TestParse(t *testing.T) {
+	got, err := Parse(strings.NewReader(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Default()
+	want.ShutdownGrace.Duration = 5 * time.Second
+	want.AnnounceTTL.Duration = time.Minute
+	want.Devices = []Device{{
+		Name:      "wg0",
+		Port:      9000,
+		Addresses: []string{"10.0.0.1", "fd00::1"},
+	}, {
+		Name: "wg1",
+		Port: 9001,
+	}}
+	want.ACL = &ACL{
+		Allow: []string{"fjCs9/W9VrlzkdcuqaJgZFolrLIMDX3KtYmHoxMotl4="},
+	}
+	want.Retry = &Retry{
+		Delay: Duration{2 * time.Second},
+	}
+	want.Auth = &Auth{
+		SessionTTL: Duration{5 * time.Minute},
+	}
+	want.Repair.Interval.Duration = 0
+	want.Repair.Endpoints = []string{"203.0.113.1:51820"}
+	want.Gossip.Interval.Duration = time.Minute
+	want.Log.File = "/tmp/wire-directory.log"
+	want.Log.Format = "json"
+	want.Log.Level = slog.LevelDebug
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Parse() =\n%+v\nwant\n%+v", got, want)
+	}
+	if eps := got.Endpoints(); len(eps) != 1 || eps[0].Port != 51820 {
+		t.Errorf("Endpoints() = %v", eps)
+	}
+}
+
+func TestParse_error(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantKey string
+	}{
+		{
+			"Unknown key",
+			"[[device]]\nname = \"wg0\"\nport = 9000\nfoo = 1",
+			"device.foo",
+		},
+		{
+			"No device",
+			"shutdown_grace = \"1s\"",
+			"device",
+		},
+		{
+			"Missing name",
+			"[[device]]\nport = 9000",
+			"device[0].name",
+		},
+		{
+			"Port",
+			"[[device]]\nname = \"wg0\"\nport = 70000",
+			"device[0].port",
+		},
+		{
+			"Address",
+			"[[device]]\nname = \"wg0\"\nport = 9000\naddresses = [\"10.0.0.1\", \"foo\"]",
+			"device[0].addresses[1]",
+		},
+		{
+			"Negative duration",
+			"idle_timeout = \"-1s\"\n[[device]]\nname = \"wg0\"\nport = 9000",
+			"idle_timeout",
+		},
+		{
+			"ACL key",
+			"[[device]]\nname = \"wg0\"\nport = 9000\n[acl]\ndeny = [\"foo\"]",
+			"acl.deny[0]",
+		},
+		{
+			"Private peer key",
+			"private_peers = [\"foo\"]\n[[device]]\nname = \"wg0\"\nport = 9000",
+			"private_peers[0]",
+		},
+		{
+			"Max age",
+			"[[device]]\nname = \"wg0\"\nport = 9000\n[repair]\nmax_age = \"-1m\"",
+			"repair.max_age",
+		},
+		{
+			"Retry attempts",
+			"[[device]]\nname = \"wg0\"\nport = 9000\n[retry]\nattempts = -1",
+			"retry.attempts",
+		},
+		{
+			"Session TTL",
+			"[[device]]\nname = \"wg0\"\nport = 9000\n[auth]\nsession_ttl = \"-1s\"",
+			"auth.session_ttl",
+		},
+		{
+			"Duplicate device",
+			"[[device]]\nname = \"wg0\"\nport = 9000\n[[device]]\nname = \"wg0\"\nport = 9001",
+			"device[1].name",
+		},
+		{
+			"All devices not first",
+			"[[device]]\nname = \"wg0\"\nport = 9000\n[[device]]\nname = \"*\"\nport = 9001",
+			"device[1].name",
+		},
+		{
+			"All devices addresses",
+			"[[device]]\nname = \"*\"\nport = 9000\naddresses = [\"10.0.0.1\"]",
+			"device[0].addresses",
+		},
+		{
+			"Setting on a device",
+			"[[device]]\nname = \"wg0\"\nport = 9000\nidle_timeout = \"1s\"",
+			"device.idle_timeout",
+		},
+		{
+			"Log format",
+			"[[device]]\nname = \"wg0\"\nport = 9000\n[log]\nformat = \"xml\"",
+			"log.format",
+		},
+		{
+			"Endpoint",
+			"[[device]]\nname = \"wg0\"\nport = 9000\n[repair]\nendpoints = [\"foo\"]",
+			"repair.endpoints[0]",
+		},
+		{
+			"Fanout",
+			"[[device]]\nname = \"wg0\"\nport = 9000\n[gossip]\ninterval = \"1s\"\nfanout = 0",
+			"gossip.fanout",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.config))
+			var ce *Error
+			if !errors.As(err, &ce) {
+				t.Fatalf("Parse() err = %v, want *Error", err)
+			}
+			if ce.Key != tt.wantKey {
+				t.Errorf("Parse() err key = %s, want %s", ce.Key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestParse_syntax(t *testing.T) {
+	if _, err := Parse(strings.NewReader("[[device]\n")); err == nil {
+		t.Error("Parse() expected error")
+	}
+}
+
+func TestConfig_Server(t *testing.T) {
+	c := Default()
+	c.Devices = []Device{
+		{Name: "wg0", Port: 9000, Addresses: []string{"127.0.0.1"}},
+		{Name: "wg1", Port: 9001, Addresses: []string{"127.0.0.1"}},
+	}
+	srv, err := c.Server()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := srv.Devices(), []string{"wg0", "wg1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Server().Devices() = %v, want %v", got, want)
+	}
+	if got := srv.Listeners(); len(got) != 2 {
+		t.Errorf("Server().Listeners() = %v, want 2", got)
+	}
+
+	c.Devices = []Device{{Name: AllDevices, Port: 9000}}
+	if srv, err = c.Server(); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Listeners(); len(got) != 0 {
+		t.Errorf("Server().Listeners() = %v, want none before discovery", got)
+	}
+}
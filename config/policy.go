@@ -0,0 +1,119 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Policy is the format of a visibility policy file, see server.Policy.
+//
+// Example:
+//
+//	[groups]
+//	laptops = ["fjCs9/W9VrlzkdcuqaJgZFolrLIMDX3KtYmHoxMotl4="]
+//	servers = ["xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="]
+//
+//	[[rule]]  # laptops may find servers
+//	from = ["laptops"]
+//	to = ["servers"]
+//
+//	[[rule]]  # servers may find all peers, "*"
+//	from = ["servers"]
+//	to = ["*"]
+//
+// Lookups matching no rule, like laptops finding other laptops, are denied.
+type Policy struct {
+	// Groups of peers by name, with base64 encoded public keys
+	Groups map[string][]string `toml:"groups"`
+	Rules  []Rule              `toml:"rule"`
+}
+
+// Rule of a Policy, see server.Rule
+type Rule struct {
+	From []string `toml:"from"`
+	To   []string `toml:"to"`
+	Deny bool     `toml:"deny"`
+}
+
+// LoadPolicy loads and validates the policy file at path
+func LoadPolicy(path string) (*server.Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := ParsePolicy(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, nil
+}
+
+// ParsePolicy parses and validates a TOML policy.
+// Unknown keys are reported as an error.
+func ParsePolicy(r io.Reader) (*server.Policy, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	md, err := toml.Decode(string(data), &p)
+	if err != nil {
+		return nil, err
+	}
+	if ud := md.Undecoded(); len(ud) > 0 {
+		keys := make([]string, len(ud))
+		for i, k := range ud {
+			keys[i] = k.String()
+		}
+		sort.Strings(keys)
+		return nil, keyErr(keys[0], "unknown key")
+	}
+	return p.Policy()
+}
+
+// Policy validates p and returns the server.Policy.
+// The returned error is an *Error, pointing at the offending key.
+func (p *Policy) Policy() (*server.Policy, error) {
+	groups := make(map[string][]wgtypes.Key, len(p.Groups))
+	for name, ss := range p.Groups {
+		key := "groups." + name
+		if name == server.AnyPeer {
+			return nil, keyErr(key, "reserved group name")
+		}
+		keys, err := parseKeys(key, ss)
+		if err != nil {
+			return nil, err
+		}
+		groups[name] = keys
+	}
+	rules := make([]server.Rule, len(p.Rules))
+	for i, r := range p.Rules {
+		for _, v := range []struct {
+			key    string
+			groups []string
+		}{
+			{"from", r.From},
+			{"to", r.To},
+		} {
+			key := fmt.Sprintf("rule[%d].%s", i, v.key)
+			if len(v.groups) == 0 {
+				return nil, keyErr(key, "required")
+			}
+			for _, g := range v.groups {
+				if _, ok := groups[g]; !ok && g != server.AnyPeer {
+					return nil, keyErr(key, "unknown group %q", g)
+				}
+			}
+		}
+		rules[i] = server.Rule{From: r.From, To: r.To, Deny: r.Deny}
+	}
+	return server.NewPolicy(groups, rules)
+}
@@ -0,0 +1,114 @@
+// +build unit
+
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	testLaptop = "fjCs9/W9VrlzkdcuqaJgZFolrLIMDX3KtYmHoxMotl4="
+	testServer = "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="
+)
+
+const testPolicy = `
+[groups]
+laptops = ["` + testLaptop + `"]
+servers = ["` + testServer + `"]
+
+[[rule]]
+from = ["laptops"]
+to = ["servers"]
+
+[[rule]]
+from = ["servers"]
+to = ["*"]
+`
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, _ := wgtypes.ParseKey(testLaptop)
+	server, _ := wgtypes.ParseKey(testServer)
+	if !p.Visible(laptop, server) || !p.Visible(server, laptop) {
+		t.Error("Visible() = false, want laptops to find servers and servers to find all peers")
+	}
+	other, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Visible(laptop, other) {
+		t.Error("Visible() = true for a lookup without rule")
+	}
+}
+
+func TestParsePolicy_error(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		wantKey string
+	}{
+		{
+			"Unknown key",
+			"[[rule]]\nfrom = [\"*\"]\nto = [\"*\"]\nallow = true",
+			"rule.allow",
+		},
+		{
+			"Reserved group",
+			"[groups]\n\"*\" = []",
+			"groups.*",
+		},
+		{
+			"Key",
+			"[groups]\nlaptops = [\"" + testLaptop + "\", \"foo\"]",
+			"groups.laptops[1]",
+		},
+		{
+			"Missing from",
+			"[[rule]]\nto = [\"*\"]",
+			"rule[0].from",
+		},
+		{
+			"Unknown group",
+			"[[rule]]\nfrom = [\"*\"]\nto = [\"*\"]\n[[rule]]\nfrom = [\"*\"]\nto = [\"servers\"]",
+			"rule[1].to",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParsePolicy(strings.NewReader(tt.policy))
+			var e *Error
+			if !errors.As(err, &e) {
+				t.Fatalf("ParsePolicy() error = %v, want *Error", err)
+			}
+			if e.Key != tt.wantKey {
+				t.Errorf("ParsePolicy() error key = %q, want %q", e.Key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestConfig_Server_policy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.toml")
+	if err := os.WriteFile(path, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c := Default()
+	c.Devices = []Device{{Name: "wg0", Port: 9000, Addresses: []string{"127.0.0.1"}}}
+	c.PolicyFile = path
+	if _, err := c.Server(); err != nil {
+		t.Fatal(err)
+	}
+	c.PolicyFile = filepath.Join(t.TempDir(), "missing.toml")
+	if _, err := c.Server(); err == nil {
+		t.Error("Server() expected error for a missing policy file")
+	}
+}
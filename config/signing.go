@@ -0,0 +1,89 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Signing is the configuration of signed endpoint records,
+// see server.Record.Sign and server.TrustList.
+type Signing struct {
+	// KeyFile is the path of the Ed25519 identity key of this directory,
+	// in PEM encoded PKCS #8 form, as generated by "openssl genpkey -algorithm ed25519".
+	// Records are not signed when empty.
+	KeyFile string `toml:"key_file"`
+	// Trust list of directories, from their WireGuard public key
+	// to their base64 encoded Ed25519 public key.
+	Trust map[string]string `toml:"trust"`
+}
+
+func (s *Signing) validate(key string) error {
+	_, err := s.trustList(key + ".trust")
+	return err
+}
+
+// TrustList returns the parsed Trust list, nil when empty.
+// It is validated by Validate.
+func (s *Signing) TrustList() server.TrustList {
+	t, _ := s.trustList("")
+	return t
+}
+
+// trustList parses the Trust list, errors point at key.<wireguard key>
+func (s *Signing) trustList(key string) (server.TrustList, error) {
+	if len(s.Trust) == 0 {
+		return nil, nil
+	}
+	// Sorted, for a stable error
+	names := make([]string, 0, len(s.Trust))
+	for n := range s.Trust {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	t := make(server.TrustList, len(s.Trust))
+	for _, n := range names {
+		k, err := wgtypes.ParseKey(strings.TrimSpace(n))
+		if err != nil {
+			return nil, &Error{Key: key + "." + n, Err: err}
+		}
+		pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s.Trust[n]))
+		if err != nil {
+			return nil, &Error{Key: key + "." + n, Err: err}
+		}
+		if len(pub) != ed25519.PublicKeySize {
+			return nil, keyErr(key+"."+n, "Ed25519 public key must be %d bytes, got %d", ed25519.PublicKeySize, len(pub))
+		}
+		t[k] = ed25519.PublicKey(pub)
+	}
+	return t, nil
+}
+
+// LoadSigningKey loads the PEM encoded Ed25519 private key at path
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := pem.Decode(data)
+	if b == nil || b.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s: no PEM encoded private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return priv, nil
+}
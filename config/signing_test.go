@@ -0,0 +1,86 @@
+// +build unit
+
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestSigning_TrustList(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := "[[device]]\nname = \"wg0\"\nport = 9000\n[signing.trust]\n\"" +
+		testServer + "\" = \"" + base64.StdEncoding.EncodeToString(pub) + "\""
+	c, err := Parse(strings.NewReader(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ := wgtypes.ParseKey(testServer)
+	if got := c.Signing.TrustList(); len(got) != 1 || !got[k].Equal(pub) {
+		t.Errorf("TrustList() = %v, want %s: %v", got, k, pub)
+	}
+	if got := new(Signing).TrustList(); got != nil {
+		t.Errorf("TrustList() = %v, want nil", got)
+	}
+
+	tests := []struct {
+		name  string
+		trust string
+	}{
+		{"WireGuard key", `"foo" = "` + base64.StdEncoding.EncodeToString(pub) + `"`},
+		{"base64", `"` + testServer + `" = "foo!"`},
+		{"length", `"` + testServer + `" = "` + base64.StdEncoding.EncodeToString(pub[:16]) + `"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader("[[device]]\nname = \"wg0\"\nport = 9000\n[signing.trust]\n" + tt.trust))
+			var ce *Error
+			if !errors.As(err, &ce) || !strings.HasPrefix(ce.Key, "signing.trust.") {
+				t.Errorf("Parse() err = %v, want *Error on signing.trust", err)
+			}
+		})
+	}
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "signing.pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadSigningKey(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(priv) {
+		t.Error("LoadSigningKey() returned another key")
+	}
+
+	bad := filepath.Join(dir, "bad.pem")
+	if err = os.WriteFile(bad, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LoadSigningKey(bad); err == nil {
+		t.Error("LoadSigningKey() expected error for a file without key")
+	}
+}
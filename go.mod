@@ -1,5 +1,17 @@
 module github.com/usrpro/wire-directory
 
-go 1.12
+go 1.21
 
-require golang.zx2c4.com/wireguard/wgctrl v0.0.0-20190904205523-599d41c32142
+require (
+	github.com/BurntSushi/toml v0.3.1
+	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20190904205523-599d41c32142
+)
+
+require (
+	github.com/mdlayher/genetlink v0.0.0-20190513144241-4cdc5dab577c // indirect
+	github.com/mdlayher/netlink v0.0.0-20190614145538-d8264f87dbe3 // indirect
+	golang.org/x/crypto v0.0.0-20190829043050-9756ffdc2472 // indirect
+	golang.org/x/net v0.0.0-20190827160401-ba9fcec4b297 // indirect
+	golang.org/x/sys v0.0.0-20190830023255-19e00faab6ad // indirect
+	golang.zx2c4.com/wireguard v0.0.20190806-0.20190831134842-7937840f9631 // indirect
+)
@@ -0,0 +1,168 @@
+// Package gossip propagates endpoint records between directory servers.
+//
+// A Gossiper periodically exchanges the records of the local server with the directories
+// of a random subset of the reachable peers. Received records are merged into
+// the gossip view of the local server, with last writer wins semantics.
+// The server answers Find from this view, so that the network converges on current endpoints.
+package gossip
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/usrpro/wire-directory/client"
+	"github.com/usrpro/wire-directory/repair"
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Defaults used by New
+const (
+	DefaultInterval = 30 * time.Second
+	DefaultFanout   = 3
+	DefaultTimeout  = 5 * time.Second
+)
+
+// Gossiper exchanges records of a Server with other directories.
+// Exported fields may be changed before Run is called.
+type Gossiper struct {
+	// Interval between gossip rounds in Run.
+	Interval time.Duration
+	// Fanout is the number of peers contacted in a round.
+	Fanout int
+	// Timeout of the exchange with a single directory server.
+	Timeout time.Duration
+	// Threshold is the age of the last handshake after which a peer is not contacted.
+	Threshold time.Duration
+	// Directories returns the directory server addresses (host:port) of a reachable peer.
+	Directories func(p wgtypes.Peer) []string
+	// Authenticate on the directories as the local device, with its private key.
+	// Needed when the directories require authentication, see server.Auth.
+	Authenticate bool
+	// Logger receives the errors of Run.
+	// slog.Default is used when nil.
+	Logger server.Logger
+
+	srv    *server.Server
+	wgc    server.Backend
+	device string
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// New Gossiper for srv, which serves device.
+// srv should have Gossip enabled, in order to serve the received records.
+// Directory servers of peers are expected on port of each of their single host allowed IPs.
+func New(srv *server.Server, wgc server.Backend, device string, port uint16) *Gossiper {
+	return &Gossiper{
+		Interval:    DefaultInterval,
+		Fanout:      DefaultFanout,
+		Timeout:     DefaultTimeout,
+		Threshold:   repair.DefaultThreshold,
+		Directories: repair.HostAddrs(port),
+		srv:         srv,
+		wgc:         wgc,
+		device:      device,
+		rnd:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// logger returns the configured Logger, or slog.Default
+func (g *Gossiper) logger() server.Logger {
+	if g.Logger != nil {
+		return g.Logger
+	}
+	return slog.Default()
+}
+
+// Run gossip rounds every Interval, until ctx is done.
+// Errors of a round are send to the Logger.
+func (g *Gossiper) Run(ctx context.Context) error {
+	t := time.NewTicker(g.Interval)
+	defer t.Stop()
+	for {
+		if err := g.Round(ctx); err != nil {
+			g.logger().Warn("gossip failed", "device", g.device, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Round executes a single gossip round: the device observations and gossip view
+// of the local server are sent to the directories of Fanout random reachable peers
+// and their replies are merged into the gossip view.
+// Errors of individual directories are send to the Logger.
+func (g *Gossiper) Round(ctx context.Context) error {
+	dev, err := g.wgc.Device(g.device)
+	if err != nil {
+		return err
+	}
+	peers := g.pick(dev.Peers, time.Now().Add(-g.Threshold))
+	if len(peers) == 0 {
+		return nil
+	}
+	records := append(g.srv.Observations(dev), g.srv.Records(g.device)...)
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		for _, addr := range g.Directories(p) {
+			wg.Add(1)
+			go func(key wgtypes.Key, addr string) {
+				defer wg.Done()
+				rs, err := g.exchange(ctx, addr, dev.PrivateKey, records)
+				if err != nil {
+					g.logger().Warn("directory gossip failed", "device", g.device, "directory", addr, "error", err)
+					return
+				}
+				g.srv.MergeRecords(g.device, key, rs)
+			}(p.PublicKey, addr)
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// pick up to Fanout random peers with a handshake after since
+func (g *Gossiper) pick(peers []wgtypes.Peer, since time.Time) []wgtypes.Peer {
+	var reachable []wgtypes.Peer
+	for _, p := range peers {
+		if p.LastHandshakeTime.After(since) {
+			reachable = append(reachable, p)
+		}
+	}
+	g.mu.Lock()
+	g.rnd.Shuffle(len(reachable), func(i, j int) {
+		reachable[i], reachable[j] = reachable[j], reachable[i]
+	})
+	g.mu.Unlock()
+	if len(reachable) > g.Fanout {
+		reachable = reachable[:g.Fanout]
+	}
+	return reachable
+}
+
+// exchange records with a single directory server.
+// With Authenticate, the connection is authenticated with priv, the private key of the device.
+func (g *Gossiper) exchange(ctx context.Context, addr string, priv wgtypes.Key, records []server.Record) ([]server.Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.Timeout)
+	defer cancel()
+	c, err := client.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if g.Authenticate {
+		if _, err = c.Authenticate(ctx, priv); err != nil {
+			return nil, err
+		}
+	}
+	return c.Gossip(ctx, records)
+}
@@ -0,0 +1,176 @@
+// +build unit
+
+package gossip
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeDirectory implements the Gossip method of a directory server
+type fakeDirectory struct {
+	received []server.Record
+	reply    []server.Record
+}
+
+func (d *fakeDirectory) Gossip(rq []server.Record, rs *[]server.Record) error {
+	d.received = rq
+	*rs = d.reply
+	return nil
+}
+
+func testKey(t *testing.T) wgtypes.Key {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.PublicKey()
+}
+
+func TestGossiper_pick(t *testing.T) {
+	now := time.Now()
+	var peers []wgtypes.Peer
+	for i := 0; i < 10; i++ {
+		peers = append(peers, wgtypes.Peer{PublicKey: testKey(t), LastHandshakeTime: now})
+	}
+	peers = append(peers, wgtypes.Peer{PublicKey: testKey(t)})
+
+	g := New(new(server.Server), server.NewMemoryBackend(), "wgtest", 0)
+	got := g.pick(peers, now.Add(-time.Minute))
+	if len(got) != DefaultFanout {
+		t.Fatalf("Gossiper.pick() = %d peers, want %d", len(got), DefaultFanout)
+	}
+	for _, p := range got {
+		if p.LastHandshakeTime.IsZero() {
+			t.Errorf("Gossiper.pick() returned unreachable peer %v", p.PublicKey)
+		}
+	}
+}
+
+func TestGossiper_Round(t *testing.T) {
+	var (
+		now      = time.Now()
+		reached  = testKey(t)
+		faraway  = testKey(t)
+		endpoint = &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 51820}
+	)
+	d := &fakeDirectory{
+		reply: []server.Record{
+			{PublicKey: faraway, Endpoint: endpoint, Observed: now, Observer: reached},
+		},
+	}
+	rs := rpc.NewServer()
+	if err := rs.RegisterName("RPC", d); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(rs)
+	defer ts.Close()
+
+	wgc := server.NewMemoryBackend()
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := priv.PublicKey()
+	if err = wgc.ConfigureDevice("wgtest", wgtypes.Config{PrivateKey: &priv}); err != nil {
+		t.Fatal(err)
+	}
+	wgc.SetPeers("wgtest", wgtypes.Peer{PublicKey: reached, Endpoint: endpoint, LastHandshakeTime: now})
+
+	srv := &server.Server{Gossip: true}
+	g := New(srv, wgc, "wgtest", 0)
+	g.Directories = func(p wgtypes.Peer) []string {
+		return []string{ts.Listener.Addr().String()}
+	}
+	if err = g.Round(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sent := []server.Record{
+		{PublicKey: reached, Endpoint: endpoint, Observed: now, Observer: self},
+	}
+	if len(d.received) != 1 || d.received[0].PublicKey != reached || d.received[0].Observer != self {
+		t.Errorf("Gossiper.Round() sent %v, want %v", d.received, sent)
+	}
+	if got := srv.Records("wgtest"); len(got) != 1 || !reflect.DeepEqual(got[0].Endpoint, endpoint) || got[0].PublicKey != faraway {
+		t.Errorf("Gossiper.Round() merged %v, want %v", got, d.reply)
+	}
+}
+
+func TestGossiper_Round_authenticate(t *testing.T) {
+	var (
+		now      = time.Now()
+		faraway  = testKey(t)
+		endpoint = &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 51820}
+	)
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wgc := server.NewMemoryBackend()
+	for _, d := range []struct {
+		name  string
+		priv  wgtypes.Key
+		peers []wgtypes.Peer
+	}{
+		{"wgtest", priv, []wgtypes.Peer{{PublicKey: remote.PublicKey(), LastHandshakeTime: now}}},
+		{"wgremote", remote, []wgtypes.Peer{
+			{PublicKey: priv.PublicKey(), LastHandshakeTime: now},
+			{PublicKey: faraway, Endpoint: endpoint, LastHandshakeTime: now},
+		}},
+	} {
+		if err = wgc.ConfigureDevice(d.name, wgtypes.Config{PrivateKey: &d.priv}); err != nil {
+			t.Fatal(err)
+		}
+		wgc.SetPeers(d.name, d.peers...)
+	}
+
+	rsrv, err := server.Configure("wgremote", 0, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsrv.Backend = wgc
+	rsrv.Gossip = true
+	rsrv.Auth = &server.Auth{Required: true}
+	go rsrv.ListenAndServe()
+	defer rsrv.Close()
+	var addr string
+	for deadline := time.Now().Add(5 * time.Second); addr == ""; time.Sleep(10 * time.Millisecond) {
+		if ls := rsrv.Listeners(); len(ls) == 1 && ls[0].Bound != nil {
+			addr = ls[0].Bound.String()
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("listener not serving")
+		}
+	}
+
+	srv := &server.Server{Gossip: true}
+	g := New(srv, wgc, "wgtest", 0)
+	g.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	g.Directories = func(p wgtypes.Peer) []string {
+		return []string{addr}
+	}
+	for _, authenticate := range []bool{false, true} {
+		g.Authenticate = authenticate
+		if err = g.Round(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		got := srv.Records("wgtest")
+		if authenticate != (len(got) == 1 && got[0].PublicKey == faraway) {
+			t.Errorf("Gossiper.Round() with Authenticate %v merged %v", authenticate, got)
+		}
+	}
+}
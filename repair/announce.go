@@ -0,0 +1,181 @@
+package repair
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Announce the Candidates of the local device to the directories of all reachable peers.
+// If AnnounceReflected is set, the reflected endpoints are announced as well.
+// Errors of individual directories are send to the Logger.
+func (r *Repairer) Announce(ctx context.Context) error {
+	dev, err := r.wgc.Device(r.device)
+	if err != nil {
+		return err
+	}
+	_, fresh := split(dev.Peers, time.Now().Add(-r.Threshold))
+	var endpoints []*net.UDPAddr
+	if r.AnnounceReflected {
+		endpoints = r.reflect(ctx, fresh)
+	}
+	if r.Candidates != nil {
+		cs, err := r.Candidates(dev)
+		if err != nil {
+			return err
+		}
+		endpoints = appendUnique(endpoints, cs...)
+	}
+	if len(endpoints) > server.MaxCandidates {
+		endpoints = endpoints[:server.MaxCandidates]
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	for _, p := range fresh {
+		for _, addr := range r.Directories(p) {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				if err := r.announce(ctx, addr, endpoints); err != nil {
+					r.logger().Warn("directory announce failed", "device", r.device, "directory", addr, "error", err)
+				}
+			}(addr)
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+// announce endpoints to a single directory server
+func (r *Repairer) announce(ctx context.Context, addr string, endpoints []*net.UDPAddr) error {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	c, err := r.dial(ctx, addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Announce(ctx, endpoints)
+	return err
+}
+
+// Reflect returns the distinct endpoints of the local device,
+// as observed by the directories of all reachable peers.
+// This allows discovery of the public endpoint when behind NAT.
+// Errors of individual directories are send to the Logger.
+func (r *Repairer) Reflect(ctx context.Context) ([]*net.UDPAddr, error) {
+	dev, err := r.wgc.Device(r.device)
+	if err != nil {
+		return nil, err
+	}
+	_, fresh := split(dev.Peers, time.Now().Add(-r.Threshold))
+	return r.reflect(ctx, fresh), nil
+}
+
+// reflect asks the directories of peers concurrently for the observed endpoint
+func (r *Repairer) reflect(ctx context.Context, peers []wgtypes.Peer) []*net.UDPAddr {
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		endpoints []*net.UDPAddr
+	)
+	for _, p := range peers {
+		for _, addr := range r.Directories(p) {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				ep, err := r.whoAmI(ctx, addr)
+				if err != nil {
+					r.logger().Warn("directory reflect failed", "device", r.device, "directory", addr, "error", err)
+					return
+				}
+				if ep == nil {
+					return
+				}
+				mu.Lock()
+				endpoints = appendUnique(endpoints, ep)
+				mu.Unlock()
+			}(addr)
+		}
+	}
+	wg.Wait()
+	return endpoints
+}
+
+// whoAmI returns the local endpoint observed by a single directory server.
+// nil is returned if the directory does not know the local peer or its endpoint.
+func (r *Repairer) whoAmI(ctx context.Context, addr string) (*net.UDPAddr, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	c, err := r.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	rs, err := c.WhoAmI(ctx)
+	if err != nil || !rs.Known {
+		return nil, err
+	}
+	return rs.Endpoint, nil
+}
+
+// appendUnique appends the endpoints which are not yet in list
+func appendUnique(list []*net.UDPAddr, endpoints ...*net.UDPAddr) []*net.UDPAddr {
+outer:
+	for _, ep := range endpoints {
+		for _, l := range list {
+			if sameAddr(l, ep) {
+				continue outer
+			}
+		}
+		list = append(list, ep)
+	}
+	return list
+}
+
+// StaticCandidates returns a Candidates function for fixed endpoints,
+// for example a public or port-mapped address.
+func StaticCandidates(endpoints ...*net.UDPAddr) func(dev *wgtypes.Device) ([]*net.UDPAddr, error) {
+	return func(dev *wgtypes.Device) ([]*net.UDPAddr, error) {
+		return endpoints, nil
+	}
+}
+
+// LocalCandidates is a Candidates function which returns the global and private unicast addresses
+// of all network interfaces, except loopback and the WireGuard device itself,
+// combined with the listen port of the device.
+// At most server.MaxCandidates endpoints are returned.
+func LocalCandidates(dev *wgtypes.Device) ([]*net.UDPAddr, error) {
+	itfs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var endpoints []*net.UDPAddr
+	for _, itf := range itfs {
+		if itf.Flags&net.FlagUp == 0 || itf.Flags&net.FlagLoopback != 0 || itf.Name == dev.Name {
+			continue
+		}
+		addrs, err := itf.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if !ok || !ipn.IP.IsGlobalUnicast() {
+				continue
+			}
+			endpoints = append(endpoints, &net.UDPAddr{IP: ipn.IP, Port: dev.ListenPort})
+			if len(endpoints) == server.MaxCandidates {
+				return endpoints, nil
+			}
+		}
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,316 @@
+// Package repair restores lost WireGuard connections.
+//
+// A Repairer watches the local WireGuard device for peers without a recent handshake.
+// The endpoints of those stale peers are looked up on the directory servers of the peers
+// that are still reachable and a fresher endpoint, if any, is applied to the device.
+package repair
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/usrpro/wire-directory/client"
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Device gives access to the local WireGuard device.
+// It is implemented by *wgctrl.Client.
+type Device interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+}
+
+// Defaults used by New
+const (
+	// DefaultThreshold equals WireGuard's reject-after time.
+	// A peer without handshake for this long has no valid session.
+	DefaultThreshold = 180 * time.Second
+	DefaultInterval  = 30 * time.Second
+	DefaultTimeout   = 5 * time.Second
+)
+
+// Repairer repairs the endpoints of stale peers on a WireGuard device.
+// Exported fields may be changed before Run is called.
+type Repairer struct {
+	// Threshold is the age of the last handshake after which a peer is stale.
+	Threshold time.Duration
+	// Interval between repair passes in Run.
+	Interval time.Duration
+	// Timeout of the lookup on a single directory server.
+	Timeout time.Duration
+	// MaxAge of the endpoints and candidates returned by directories,
+	// older observations are dropped by the directory. All are used when zero.
+	MaxAge time.Duration
+	// Directories returns the directory server addresses (host:port) of a reachable peer.
+	Directories func(p wgtypes.Peer) []string
+	// Candidates returns the endpoints of the local device, announced by Run
+	// to the directories of reachable peers. Announcing is disabled when nil.
+	Candidates func(dev *wgtypes.Device) ([]*net.UDPAddr, error)
+	// AnnounceReflected adds the endpoints of the local device, as observed by the directories
+	// of reachable peers, to the announced candidates.
+	AnnounceReflected bool
+	// Authenticate on the directories as the local device, with its private key.
+	// Needed when the directories require authentication, see server.Auth.
+	Authenticate bool
+	// Trust list of directories which sign endpoint records.
+	// When set, only endpoints signed by a trusted directory are applied and
+	// announced candidates are ignored, see client.Verify.
+	Trust server.TrustList
+	// Logger receives the errors and repaired peers of Run.
+	// slog.Default is used when nil.
+	Logger server.Logger
+
+	device string
+	wgc    Device
+}
+
+// New Repairer for device. Directory servers of reachable peers are expected
+// on port of each of their single host allowed IPs.
+func New(wgc Device, device string, port uint16) *Repairer {
+	return &Repairer{
+		Threshold:   DefaultThreshold,
+		Interval:    DefaultInterval,
+		Timeout:     DefaultTimeout,
+		Directories: HostAddrs(port),
+		device:      device,
+		wgc:         wgc,
+	}
+}
+
+// logger returns the configured Logger, or slog.Default
+func (r *Repairer) logger() server.Logger {
+	if r.Logger != nil {
+		return r.Logger
+	}
+	return slog.Default()
+}
+
+// HostAddrs returns a Directories function which uses all allowed IPs of a peer
+// that describe a single host (/32 or /128), combined with port.
+func HostAddrs(port uint16) func(p wgtypes.Peer) []string {
+	ps := strconv.Itoa(int(port))
+	return func(p wgtypes.Peer) []string {
+		var addrs []string
+		for _, n := range p.AllowedIPs {
+			if ones, bits := n.Mask.Size(); bits == 0 || ones != bits {
+				continue
+			}
+			addrs = append(addrs, net.JoinHostPort(n.IP.String(), ps))
+		}
+		return addrs
+	}
+}
+
+// Run repair passes every Interval, until ctx is done.
+// Errors of a pass are send to the Logger.
+func (r *Repairer) Run(ctx context.Context) error {
+	t := time.NewTicker(r.Interval)
+	defer t.Stop()
+	for {
+		if r.Candidates != nil || r.AnnounceReflected {
+			if err := r.Announce(ctx); err != nil {
+				r.logger().Warn("announce failed", "device", r.device, "error", err)
+			}
+		}
+		keys, err := r.Repair(ctx)
+		if err != nil {
+			r.logger().Warn("repair failed", "device", r.device, "error", err)
+		}
+		for _, k := range keys {
+			r.logger().Info("repaired endpoint", "device", r.device, "peer", k.String())
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Repair executes a single repair pass and returns the keys of the peers
+// which received a new endpoint.
+//
+// A stale peer receives the endpoint of the directory with the most recent handshake,
+// if that handshake is more recent than its own.
+// Otherwise, the next of the candidates announced by the peer is tried,
+// if announced after its last handshake.
+func (r *Repairer) Repair(ctx context.Context) ([]wgtypes.Key, error) {
+	dev, err := r.wgc.Device(r.device)
+	if err != nil {
+		return nil, err
+	}
+	stale, fresh := split(dev.Peers, time.Now().Add(-r.Threshold))
+	if len(stale) == 0 || len(fresh) == 0 {
+		return nil, nil
+	}
+	keys := make([]wgtypes.Key, len(stale))
+	for i, p := range stale {
+		keys[i] = p.PublicKey
+	}
+	found := r.lookup(ctx, fresh, keys)
+
+	var (
+		conf     wgtypes.Config
+		repaired []wgtypes.Key
+	)
+	for _, p := range stale {
+		f, ok := found[p.PublicKey]
+		if !ok {
+			continue
+		}
+		ep := choose(p, f)
+		if ep == nil {
+			continue
+		}
+		conf.Peers = append(conf.Peers, wgtypes.PeerConfig{
+			PublicKey: p.PublicKey,
+			Endpoint:  ep,
+		})
+		repaired = append(repaired, p.PublicKey)
+	}
+	if len(repaired) == 0 {
+		return nil, nil
+	}
+	if err = r.wgc.ConfigureDevice(r.device, conf); err != nil {
+		return nil, fmt.Errorf("configure %s: %w", r.device, err)
+	}
+	return repaired, nil
+}
+
+// split peers in stale and fresh, based on their last handshake before or after since
+func split(peers []wgtypes.Peer, since time.Time) (stale, fresh []wgtypes.Peer) {
+	for _, p := range peers {
+		if p.LastHandshakeTime.After(since) {
+			fresh = append(fresh, p)
+		} else {
+			stale = append(stale, p)
+		}
+	}
+	return stale, fresh
+}
+
+// choose a new endpoint for the stale peer p from the lookup result f.
+// Returns nil if there is no better endpoint.
+func choose(p wgtypes.Peer, f server.Peer) *net.UDPAddr {
+	if f.Endpoint != nil && f.LastHandshakeTime.After(p.LastHandshakeTime) && !sameAddr(f.Endpoint, p.Endpoint) {
+		return f.Endpoint
+	}
+	if len(f.Candidates) == 0 || !f.Announced.After(p.LastHandshakeTime) {
+		return nil
+	}
+	// Rotate through the candidates on each pass
+	next := f.Candidates[0]
+	for i, c := range f.Candidates {
+		if sameAddr(c, p.Endpoint) {
+			next = f.Candidates[(i+1)%len(f.Candidates)]
+			break
+		}
+	}
+	if sameAddr(next, p.Endpoint) {
+		return nil
+	}
+	return next
+}
+
+// merge the endpoint and candidates of b into a, where they are more recent
+func merge(a, b server.Peer) server.Peer {
+	if b.Endpoint != nil && (a.Endpoint == nil || b.LastHandshakeTime.After(a.LastHandshakeTime)) {
+		a.Endpoint, a.LastHandshakeTime = b.Endpoint, b.LastHandshakeTime
+	}
+	if len(b.Candidates) > 0 && (len(a.Candidates) == 0 || b.Announced.After(a.Announced)) {
+		a.Candidates, a.Announced = b.Candidates, b.Announced
+	}
+	return a
+}
+
+// lookup keys on the directories of peers concurrently.
+// For each key, the endpoint with the most recent handshake
+// and the most recently announced candidates are returned.
+// Errors of individual directories are send to the Logger.
+func (r *Repairer) lookup(ctx context.Context, peers []wgtypes.Peer, keys []wgtypes.Key) map[wgtypes.Key]server.Peer {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		found = make(map[wgtypes.Key]server.Peer)
+	)
+	for _, p := range peers {
+		for _, addr := range r.Directories(p) {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				pm, err := r.find(ctx, addr, keys)
+				if err != nil {
+					r.logger().Warn("directory lookup failed", "device", r.device, "directory", addr, "error", err)
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				for k, fp := range pm {
+					if fp.Status == server.Found {
+						found[k] = merge(found[k], fp)
+					}
+				}
+			}(addr)
+		}
+	}
+	wg.Wait()
+	return found
+}
+
+// dial the directory server on addr.
+// With Authenticate, the connection is authenticated with the private key of the device.
+func (r *Repairer) dial(ctx context.Context, addr string) (*client.Client, error) {
+	c, err := client.Dial(ctx, addr)
+	if err != nil || !r.Authenticate {
+		return c, err
+	}
+	dev, err := r.wgc.Device(r.device)
+	if err == nil {
+		_, err = c.Authenticate(ctx, dev.PrivateKey)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// find keys on a single directory server
+func (r *Repairer) find(ctx context.Context, addr string, keys []wgtypes.Key) (map[wgtypes.Key]server.Peer, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
+	defer cancel()
+	c, err := r.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	var pm server.PeerMap
+	if r.MaxAge > 0 {
+		pm, err = c.Lookup(ctx, server.FindRequest{Keys: keys, MaxAge: r.MaxAge})
+	} else {
+		pm, err = c.Find(ctx, keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.Trust != nil {
+		if err = client.Verify(&pm, r.Trust, r.MaxAge); err != nil {
+			r.logger().Warn("unverified endpoints", "device", r.device, "directory", addr, "error", err)
+		}
+	}
+	return pm.Peers, nil
+}
+
+// sameAddr reports whether a and b are the same UDP address
+func sameAddr(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
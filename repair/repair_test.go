@@ -0,0 +1,354 @@
+// +build unit
+
+package repair
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"net/rpc"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/usrpro/wire-directory/server"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeDirectory implements the Find, FindDevice and WhoAmI methods of a directory server
+type fakeDirectory struct {
+	peers    map[wgtypes.Key]server.Peer
+	observed *net.UDPAddr
+	// maxAge of the last FindDevice call
+	maxAge time.Duration
+}
+
+func (d *fakeDirectory) WhoAmI(rq struct{}, rs *server.Reflection) error {
+	rs.Known = d.observed != nil
+	rs.Endpoint = d.observed
+	return nil
+}
+
+func (d *fakeDirectory) Find(rq []wgtypes.Key, rs *server.PeerMap) error {
+	rs.Peers = make(map[wgtypes.Key]server.Peer)
+	for _, k := range rq {
+		rs.Peers[k] = d.peers[k]
+	}
+	return nil
+}
+
+func (d *fakeDirectory) FindDevice(rq server.FindRequest, rs *server.PeerMap) error {
+	d.maxAge = rq.MaxAge
+	rs.Peers = make(map[wgtypes.Key]server.Peer)
+	for _, k := range rq.Keys {
+		p := d.peers[k]
+		if p.Status == server.Found && time.Since(p.LastHandshakeTime) > rq.MaxAge {
+			p.Status, p.Endpoint = server.NoEndpoint, nil
+		}
+		rs.Peers[k] = p
+	}
+	return nil
+}
+
+func testKey(t *testing.T) wgtypes.Key {
+	k, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k.PublicKey()
+}
+
+func TestHostAddrs(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.168.0.0/24")
+	_, host4, _ := net.ParseCIDR("10.0.0.1/32")
+	_, host6, _ := net.ParseCIDR("fd00::1/128")
+	p := wgtypes.Peer{AllowedIPs: []net.IPNet{*lan, *host4, *host6}}
+	want := []string{"10.0.0.1:9000", "[fd00::1]:9000"}
+	if got := HostAddrs(9000)(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("HostAddrs() = %v, want %v", got, want)
+	}
+}
+
+func Test_split(t *testing.T) {
+	now := time.Now()
+	peers := []wgtypes.Peer{
+		{LastHandshakeTime: now},
+		{LastHandshakeTime: now.Add(-time.Hour)},
+		{},
+	}
+	stale, fresh := split(peers, now.Add(-time.Minute))
+	if !reflect.DeepEqual(fresh, peers[:1]) {
+		t.Errorf("split() fresh = %v, want %v", fresh, peers[:1])
+	}
+	if !reflect.DeepEqual(stale, peers[1:]) {
+		t.Errorf("split() stale = %v, want %v", stale, peers[1:])
+	}
+}
+
+func TestRepairer_Repair(t *testing.T) {
+	var (
+		now       = time.Now()
+		reachable = testKey(t)
+		lost      = testKey(t)
+		unknown   = testKey(t)
+		old       = &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}
+		moved     = &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 2}
+	)
+	rs := rpc.NewServer()
+	err := rs.RegisterName("RPC", &fakeDirectory{
+		peers: map[wgtypes.Key]server.Peer{
+			lost: {
+				Status:            server.Found,
+				PublicKey:         lost,
+				Endpoint:          moved,
+				LastHandshakeTime: now,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(rs)
+	defer ts.Close()
+
+	wgc := server.NewMemoryBackend()
+	wgc.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: reachable, LastHandshakeTime: now},
+		wgtypes.Peer{PublicKey: lost, Endpoint: old, LastHandshakeTime: now.Add(-time.Hour)},
+		wgtypes.Peer{PublicKey: unknown, Endpoint: old},
+	)
+	r := New(wgc, "wgtest", 0)
+	r.Directories = func(p wgtypes.Peer) []string {
+		if p.PublicKey != reachable {
+			t.Errorf("Directories() called for stale peer %v", p.PublicKey)
+		}
+		return []string{ts.Listener.Addr().String()}
+	}
+
+	got, err := r.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []wgtypes.Key{lost}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Repairer.Repair() = %v, want %v", got, want)
+	}
+	dev, err := wgc.Device("wgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*net.UDPAddr{nil, moved, old}
+	for i, p := range dev.Peers {
+		if !reflect.DeepEqual(p.Endpoint, want[i]) {
+			t.Errorf("Repairer.Repair() endpoint of %v = %v, want %v", p.PublicKey, p.Endpoint, want[i])
+		}
+	}
+}
+
+func Test_choose(t *testing.T) {
+	var (
+		now = time.Now()
+		a   = &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}
+		b   = &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 2}
+		c   = &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 3}
+	)
+	stale := wgtypes.Peer{Endpoint: a, LastHandshakeTime: now.Add(-time.Hour)}
+	tests := []struct {
+		name string
+		f    server.Peer
+		want *net.UDPAddr
+	}{
+		{
+			name: "fresher endpoint",
+			f:    server.Peer{Endpoint: b, LastHandshakeTime: now},
+			want: b,
+		},
+		{
+			name: "older endpoint",
+			f:    server.Peer{Endpoint: b, LastHandshakeTime: now.Add(-2 * time.Hour)},
+		},
+		{
+			name: "same endpoint",
+			f:    server.Peer{Endpoint: a, LastHandshakeTime: now},
+		},
+		{
+			name: "next candidate",
+			f:    server.Peer{Candidates: []*net.UDPAddr{c, a, b}, Announced: now},
+			want: b,
+		},
+		{
+			name: "wrap candidates",
+			f:    server.Peer{Candidates: []*net.UDPAddr{b, a}, Announced: now},
+			want: b,
+		},
+		{
+			name: "only current candidate",
+			f:    server.Peer{Candidates: []*net.UDPAddr{a}, Announced: now},
+		},
+		{
+			name: "old candidates",
+			f:    server.Peer{Candidates: []*net.UDPAddr{b}, Announced: now.Add(-2 * time.Hour)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := choose(stale, tt.f); got != tt.want {
+				t.Errorf("choose() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_merge(t *testing.T) {
+	var (
+		now = time.Now()
+		a   = &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}
+		b   = &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 2}
+	)
+	got := merge(
+		server.Peer{Endpoint: a, LastHandshakeTime: now, Candidates: []*net.UDPAddr{a}, Announced: now.Add(-time.Hour)},
+		server.Peer{Endpoint: b, LastHandshakeTime: now.Add(-time.Hour), Candidates: []*net.UDPAddr{b}, Announced: now},
+	)
+	want := server.Peer{Endpoint: a, LastHandshakeTime: now, Candidates: []*net.UDPAddr{b}, Announced: now}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("merge() = %v, want %v", got, want)
+	}
+}
+
+func TestRepairer_Reflect(t *testing.T) {
+	observed := &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 51820}
+	var addrs []string
+	for _, d := range []*fakeDirectory{{observed: observed}, {observed: observed}, {}} {
+		rs := rpc.NewServer()
+		if err := rs.RegisterName("RPC", d); err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(rs)
+		defer ts.Close()
+		addrs = append(addrs, ts.Listener.Addr().String())
+	}
+	wgc := server.NewMemoryBackend()
+	wgc.SetPeers("wgtest", wgtypes.Peer{PublicKey: testKey(t), LastHandshakeTime: time.Now()})
+	r := New(wgc, "wgtest", 0)
+	r.Directories = func(p wgtypes.Peer) []string {
+		return addrs
+	}
+	got, err := r.Reflect(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*net.UDPAddr{observed}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Repairer.Reflect() = %v, want %v", got, want)
+	}
+}
+
+func TestRepairer_Repair_maxAge(t *testing.T) {
+	var (
+		now       = time.Now()
+		reachable = testKey(t)
+		lost      = testKey(t)
+		old       = &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}
+	)
+	d := &fakeDirectory{
+		peers: map[wgtypes.Key]server.Peer{
+			// Newer than the local handshake, but older than MaxAge
+			lost: {
+				Status:            server.Found,
+				PublicKey:         lost,
+				Endpoint:          &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 2},
+				LastHandshakeTime: now.Add(-30 * time.Minute),
+			},
+		},
+	}
+	rs := rpc.NewServer()
+	if err := rs.RegisterName("RPC", d); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(rs)
+	defer ts.Close()
+
+	wgc := server.NewMemoryBackend()
+	wgc.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: reachable, LastHandshakeTime: now},
+		wgtypes.Peer{PublicKey: lost, Endpoint: old, LastHandshakeTime: now.Add(-time.Hour)},
+	)
+	r := New(wgc, "wgtest", 0)
+	r.MaxAge = 10 * time.Minute
+	r.Directories = func(p wgtypes.Peer) []string {
+		return []string{ts.Listener.Addr().String()}
+	}
+	got, err := r.Repair(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Repairer.Repair() = %v, want none", got)
+	}
+	if d.maxAge != r.MaxAge {
+		t.Errorf("directory max age = %v, want %v", d.maxAge, r.MaxAge)
+	}
+}
+
+func TestRepairer_Repair_authenticate(t *testing.T) {
+	var (
+		now   = time.Now()
+		lost  = testKey(t)
+		old   = &net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}
+		moved = &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 2}
+	)
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wgc := server.NewMemoryBackend()
+	if err = wgc.ConfigureDevice("wgtest", wgtypes.Config{PrivateKey: &priv}); err != nil {
+		t.Fatal(err)
+	}
+	wgc.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: remote.PublicKey(), LastHandshakeTime: now},
+		wgtypes.Peer{PublicKey: lost, Endpoint: old, LastHandshakeTime: now.Add(-time.Hour)},
+	)
+	wgc.SetPeers("wgremote",
+		wgtypes.Peer{PublicKey: priv.PublicKey(), LastHandshakeTime: now},
+		wgtypes.Peer{PublicKey: lost, Endpoint: moved, LastHandshakeTime: now},
+	)
+
+	srv, err := server.Configure("wgremote", 0, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Backend = wgc
+	srv.Auth = &server.Auth{Required: true}
+	go srv.ListenAndServe()
+	defer srv.Close()
+	var addr string
+	for deadline := time.Now().Add(5 * time.Second); addr == ""; time.Sleep(10 * time.Millisecond) {
+		if ls := srv.Listeners(); len(ls) == 1 && ls[0].Bound != nil {
+			addr = ls[0].Bound.String()
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("listener not serving")
+		}
+	}
+
+	r := New(wgc, "wgtest", 0)
+	r.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	r.Directories = func(p wgtypes.Peer) []string {
+		return []string{addr}
+	}
+	for _, authenticate := range []bool{false, true} {
+		r.Authenticate = authenticate
+		got, err := r.Repair(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authenticate != (len(got) == 1) {
+			t.Errorf("Repairer.Repair() with Authenticate %v = %v", authenticate, got)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// ACL restricts access to the RPC server to callers that are peers of the WireGuard device.
+// The remote address of a caller must be in the AllowedIPs of a device peer,
+// which is then used as the caller's identity.
+// The connection needs to be made to an address of the device.
+//
+// Only single host AllowedIPs (/32 and /128) identify a caller by default:
+// traffic from a network route, like the default route of a gateway peer,
+// may originate from any host behind or even outside of the peer.
+// Use authentication for a strong identity, see Auth.
+type ACL struct {
+	// Allow only the peers with these public keys, if not empty.
+	Allow []wgtypes.Key
+	// Deny the peers with these public keys.
+	// Deny takes precedence over Allow.
+	Deny []wgtypes.Key
+	// Networks also identifies callers by AllowedIPs which are networks,
+	// like the LAN of a site-to-site peer. Default routes never identify a caller.
+	Networks bool
+}
+
+// Access control errors
+var (
+	ErrUnknownCaller = errors.New("caller is not a peer")
+	ErrDenied        = errors.New("peer denied")
+)
+
+// permits reports whether the peer with key may access the RPC server
+func (a *ACL) permits(key wgtypes.Key) bool {
+	for _, k := range a.Deny {
+		if k == key {
+			return false
+		}
+	}
+	if len(a.Allow) == 0 {
+		return true
+	}
+	for _, k := range a.Allow {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// peerByKey returns the peer with the public key
+func peerByKey(peers []wgtypes.Peer, key wgtypes.Key) (wgtypes.Peer, bool) {
+	for _, p := range peers {
+		if p.PublicKey == key {
+			return p, true
+		}
+	}
+	return wgtypes.Peer{}, false
+}
+
+// peerByIP returns the peer which AllowedIPs contain ip.
+// As in WireGuard's cryptokey routing, the longest prefix wins.
+// Only single host AllowedIPs are matched, and networks when set;
+// default routes are never matched.
+func peerByIP(peers []wgtypes.Peer, ip net.IP, networks bool) (wgtypes.Peer, bool) {
+	var (
+		match wgtypes.Peer
+		best  = -1
+	)
+	for _, p := range peers {
+		for _, n := range p.AllowedIPs {
+			ones, bits := n.Mask.Size()
+			if ones == 0 || ones != bits && !networks {
+				continue
+			}
+			if ones > best && n.Contains(ip) {
+				match, best = p, ones
+			}
+		}
+	}
+	return match, best >= 0
+}
+
+// onDevice reports whether r was received on an address of device.
+// Requests without local address are not received on a connection and pass.
+func (h *handler) onDevice(device string, r *http.Request) (bool, error) {
+	la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return true, nil
+	}
+	host, _, err := net.SplitHostPort(la.String())
+	if err != nil {
+		return false, err
+	}
+	local := net.ParseIP(host)
+	ifaceIPs := h.srv.ifaceIPs
+	if ifaceIPs == nil {
+		ifaceIPs = itfIPs
+	}
+	ips, err := ifaceIPs(device)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		if ip.Equal(local) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// authorize the caller of r against the ACL of the server and the peers of the handler's device.
+// Returns a nil caller if access control is disabled.
+// On error, the HTTP status code to respond with is returned.
+func (h *handler) authorize(r *http.Request) (*wgtypes.Peer, int, error) {
+	return h.authorizeDevice(h.device, r)
+}
+
+// authorizeDevice is authorize, against the peers of device.
+// With authentication, the caller is identified by the session token of r, if any.
+func (h *handler) authorizeDevice(device string, r *http.Request) (*wgtypes.Peer, int, error) {
+	if auth := h.srv.Auth; auth != nil {
+		if token, ok := bearerToken(r); ok {
+			key, ok := h.srv.sessions.get(token, time.Now())
+			if !ok {
+				return nil, http.StatusUnauthorized, ErrAuthFailed
+			}
+			return h.authorizeKey(device, key)
+		}
+		if auth.Required {
+			return nil, http.StatusUnauthorized, ErrUnauthenticated
+		}
+	}
+	acl := h.srv.ACL
+	if acl == nil {
+		return nil, http.StatusOK, nil
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("Invalid IP address: %s", host)
+	}
+	if ok, err := h.onDevice(device, r); err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	} else if !ok {
+		return nil, http.StatusForbidden, fmt.Errorf("%w: connection not on an address of %s", ErrUnknownCaller, device)
+	}
+	dev, err := h.backend().Device(device)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	p, ok := peerByIP(dev.Peers, ip, acl.Networks)
+	if !ok {
+		return nil, http.StatusForbidden, ErrUnknownCaller
+	}
+	if !acl.permits(p.PublicKey) {
+		return nil, http.StatusForbidden, fmt.Errorf("%w: %s", ErrDenied, p.PublicKey)
+	}
+	return &p, http.StatusOK, nil
+}
+
+// authorizeKey authorizes the peer with key of device against the ACL of the server,
+// when the key is authenticated.
+func (h *handler) authorizeKey(device string, key wgtypes.Key) (*wgtypes.Peer, int, error) {
+	dev, err := h.backend().Device(device)
+	if err != nil {
+		return nil, http.StatusServiceUnavailable, err
+	}
+	p, ok := peerByKey(dev.Peers, key)
+	if !ok {
+		return nil, http.StatusForbidden, ErrUnknownCaller
+	}
+	if acl := h.srv.ACL; acl != nil && !acl.permits(key) {
+		return nil, http.StatusForbidden, fmt.Errorf("%w: %s", ErrDenied, key)
+	}
+	return &p, http.StatusOK, nil
+}
+
+// challengeable reports whether the caller of r, which failed authorize with err,
+// may connect to authenticate, see RPC.Challenge.
+func (h *handler) challengeable(r *http.Request, err error) bool {
+	if h.srv.Auth == nil || r.Method != http.MethodConnect {
+		return false
+	}
+	return errors.Is(err, ErrUnauthenticated) || errors.Is(err, ErrUnknownCaller) || errors.Is(err, ErrDenied)
+}
@@ -0,0 +1,252 @@
+// +build unit
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func genKeys(t *testing.T, n int) []wgtypes.Key {
+	keys := make([]wgtypes.Key, n)
+	for i := range keys {
+		k, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[i] = k.PublicKey()
+	}
+	return keys
+}
+
+func TestACL_permits(t *testing.T) {
+	keys := genKeys(t, 3)
+	tests := []struct {
+		name string
+		acl  ACL
+		key  wgtypes.Key
+		want bool
+	}{
+		{
+			name: "empty",
+			key:  keys[0],
+			want: true,
+		},
+		{
+			name: "allowed",
+			acl:  ACL{Allow: keys[:2]},
+			key:  keys[1],
+			want: true,
+		},
+		{
+			name: "not allowed",
+			acl:  ACL{Allow: keys[:2]},
+			key:  keys[2],
+		},
+		{
+			name: "denied",
+			acl:  ACL{Deny: keys[:1]},
+			key:  keys[0],
+		},
+		{
+			name: "allowed and denied",
+			acl:  ACL{Allow: keys, Deny: keys[:1]},
+			key:  keys[0],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.acl.permits(tt.key); got != tt.want {
+				t.Errorf("ACL.permits() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// loopbackIPs replaces the interface addresses of the test devices,
+// so that ACL tests can connect over the loopback.
+func loopbackIPs(string) ([]net.IP, error) {
+	return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, nil
+}
+
+func Test_peerByIP(t *testing.T) {
+	keys := genKeys(t, 3)
+	_, lan, _ := net.ParseCIDR("10.0.0.0/24")
+	_, host, _ := net.ParseCIDR("10.0.0.1/32")
+	_, any4, _ := net.ParseCIDR("0.0.0.0/0")
+	_, any6, _ := net.ParseCIDR("::/0")
+	peers := []wgtypes.Peer{
+		{PublicKey: keys[0], AllowedIPs: []net.IPNet{*lan}},
+		{PublicKey: keys[1], AllowedIPs: []net.IPNet{*host}},
+		{PublicKey: keys[2], AllowedIPs: []net.IPNet{*any4, *any6}},
+	}
+	tests := []struct {
+		name     string
+		ip       net.IP
+		networks bool
+		want     wgtypes.Key
+		wantOK   bool
+	}{
+		{
+			name: "network",
+			ip:   net.ParseIP("10.0.0.2"),
+		},
+		{
+			name:     "network allowed",
+			ip:       net.ParseIP("10.0.0.2"),
+			networks: true,
+			want:     keys[0],
+			wantOK:   true,
+		},
+		{
+			name:   "longest prefix",
+			ip:     net.ParseIP("10.0.0.1"),
+			want:   keys[1],
+			wantOK: true,
+		},
+		{
+			name: "unknown",
+			ip:   net.ParseIP("192.168.0.1"),
+		},
+		{
+			name:     "default route",
+			ip:       net.ParseIP("192.168.0.1"),
+			networks: true,
+		},
+		{
+			name:     "IPv6 default route",
+			ip:       net.ParseIP("fd00::1"),
+			networks: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := peerByIP(peers, tt.ip, tt.networks)
+			if ok != tt.wantOK || got.PublicKey != tt.want {
+				t.Errorf("peerByIP() = %v, %v, want %v, %v", got.PublicKey, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_handler_authorize(t *testing.T) {
+	keys := genKeys(t, 2)
+	_, ipn0, _ := net.ParseCIDR("10.0.0.1/32")
+	_, ipn1, _ := net.ParseCIDR("10.0.0.2/32")
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: keys[0], AllowedIPs: []net.IPNet{*ipn0}},
+		wgtypes.Peer{PublicKey: keys[1], AllowedIPs: []net.IPNet{*ipn1}},
+	)
+	tests := []struct {
+		name       string
+		device     string
+		acl        *ACL
+		remoteAddr string
+		localAddr  string
+		want       *wgtypes.Key
+		wantStatus int
+		wantErr    bool
+	}{
+		{
+			name:       "disabled",
+			device:     "wgtest",
+			remoteAddr: "192.168.0.1:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "peer",
+			device:     "wgtest",
+			acl:        &ACL{},
+			remoteAddr: "10.0.0.1:1234",
+			want:       &keys[0],
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "peer on device address",
+			device:     "wgtest",
+			acl:        &ACL{},
+			remoteAddr: "10.0.0.1:1234",
+			localAddr:  "10.0.0.254:9000",
+			want:       &keys[0],
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "other local address",
+			device:     "wgtest",
+			acl:        &ACL{},
+			remoteAddr: "10.0.0.1:1234",
+			localAddr:  "192.168.0.254:9000",
+			wantStatus: http.StatusForbidden,
+			wantErr:    true,
+		},
+		{
+			name:       "unknown caller",
+			device:     "wgtest",
+			acl:        &ACL{},
+			remoteAddr: "192.168.0.1:1234",
+			wantStatus: http.StatusForbidden,
+			wantErr:    true,
+		},
+		{
+			name:       "denied peer",
+			device:     "wgtest",
+			acl:        &ACL{Deny: keys[1:]},
+			remoteAddr: "10.0.0.2:1234",
+			wantStatus: http.StatusForbidden,
+			wantErr:    true,
+		},
+		{
+			name:       "bogus remote address",
+			device:     "wgtest",
+			acl:        &ACL{},
+			remoteAddr: "foo",
+			wantStatus: http.StatusBadRequest,
+			wantErr:    true,
+		},
+		{
+			name:       "bogus device",
+			device:     "foo",
+			acl:        &ACL{},
+			remoteAddr: "192.168.0.1:1234",
+			wantStatus: http.StatusServiceUnavailable,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &Server{ACL: tt.acl, Backend: m}
+			srv.ifaceIPs = func(string) ([]net.IP, error) {
+				return []net.IP{net.ParseIP("10.0.0.254")}, nil
+			}
+			h, err := newHandler(tt.device, srv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodConnect, "/_goRPC_", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.localAddr != "" {
+				la, err := net.ResolveTCPAddr("tcp", tt.localAddr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, la))
+			}
+			got, status, err := h.authorize(r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handler.authorize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if status != tt.wantStatus {
+				t.Errorf("handler.authorize() status = %v, want %v", status, tt.wantStatus)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && got.PublicKey != *tt.want {
+				t.Errorf("handler.authorize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
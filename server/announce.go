@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultAnnounceTTL is the time an announcement is served,
+// when not configured on the Server.
+const DefaultAnnounceTTL = 10 * time.Minute
+
+// MaxCandidates is the maximum number of endpoints in an Announcement
+const MaxCandidates = 16
+
+// Announce errors
+var (
+	// ErrNoCaller is returned by Announce when the caller has no peer identity.
+	// Access control needs to be enabled on the server for announcements.
+	ErrNoCaller = errors.New("caller identity unknown, access control disabled")
+	// ErrInvalidCandidate is returned for unusable endpoints in an Announcement
+	ErrInvalidCandidate = errors.New("invalid candidate endpoint")
+)
+
+// Announcement of candidate endpoints by a peer, for itself.
+// For example LAN, public, IPv6 or port-mapped addresses.
+type Announcement struct {
+	Endpoints []*net.UDPAddr
+}
+
+// validate the endpoints of an Announcement
+func (a *Announcement) validate() error {
+	if len(a.Endpoints) > MaxCandidates {
+		return fmt.Errorf("%w: more than %d endpoints", ErrInvalidCandidate, MaxCandidates)
+	}
+	for _, ep := range a.Endpoints {
+		if ep == nil || ep.IP == nil || ep.IP.IsUnspecified() || ep.Port <= 0 || ep.Port > 65535 {
+			return fmt.Errorf("%w: %v", ErrInvalidCandidate, ep)
+		}
+	}
+	return nil
+}
+
+// AnnounceReply informs the announcing peer how long its announcement is served
+type AnnounceReply struct {
+	TTL time.Duration
+}
+
+// announced endpoint candidates of a peer
+type announced struct {
+	endpoints []*net.UDPAddr
+	time      time.Time
+}
+
+// announcements stores announced endpoints by peer key.
+// The zero value is ready to use and it is safe for concurrent use.
+// A nil *announcements stores nothing.
+type announcements struct {
+	mu sync.Mutex
+	m  map[wgtypes.Key]announced
+}
+
+// put the announcement of the peer with key, replacing any previous announcement.
+// Expired announcements are removed.
+func (as *announcements) put(key wgtypes.Key, a Announcement, now time.Time, ttl time.Duration) {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if as.m == nil {
+		as.m = make(map[wgtypes.Key]announced)
+	}
+	for k, v := range as.m {
+		if now.Sub(v.time) > ttl {
+			delete(as.m, k)
+		}
+	}
+	as.m[key] = announced{
+		endpoints: a.Endpoints,
+		time:      now,
+	}
+}
+
+// get the announcement of key, if it exists and did not expire
+func (as *announcements) get(key wgtypes.Key, now time.Time, ttl time.Duration) (announced, bool) {
+	if as == nil {
+		return announced{}, false
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	a, ok := as.m[key]
+	if !ok || now.Sub(a.time) > ttl {
+		return announced{}, false
+	}
+	return a, true
+}
+
+// Announce stores the candidate endpoints of the calling peer. Implements a net.RPC method.
+// The candidates are served by Find until the TTL in rs expires or they are replaced by a new announcement.
+// The caller is identified by access control or authentication,
+// ErrNoCaller is returned if both are disabled.
+func (s *RPC) Announce(rq Announcement, rs *AnnounceReply) (err error) {
+	defer s.done("Announce", time.Now(), &err)
+	caller, err := s.identity()
+	if err != nil {
+		return err
+	}
+	if caller == nil || s.announced == nil {
+		return ErrNoCaller
+	}
+	if err := rq.validate(); err != nil {
+		return err
+	}
+	s.announced.put(caller.PublicKey, rq, time.Now(), s.announceTTL)
+	rs.TTL = s.announceTTL
+	return nil
+}
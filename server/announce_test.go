@@ -0,0 +1,124 @@
+// +build unit
+
+package server
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestAnnouncement_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		a       Announcement
+		wantErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "valid",
+			a: Announcement{
+				Endpoints: []*net.UDPAddr{
+					{IP: net.ParseIP("192.168.0.1"), Port: 51820},
+					{IP: net.ParseIP("2001:db8::1"), Port: 51820},
+				},
+			},
+		},
+		{
+			name:    "nil endpoint",
+			a:       Announcement{Endpoints: []*net.UDPAddr{nil}},
+			wantErr: true,
+		},
+		{
+			name:    "unspecified IP",
+			a:       Announcement{Endpoints: []*net.UDPAddr{{IP: net.IPv4zero, Port: 51820}}},
+			wantErr: true,
+		},
+		{
+			name:    "no port",
+			a:       Announcement{Endpoints: []*net.UDPAddr{{IP: net.ParseIP("192.168.0.1")}}},
+			wantErr: true,
+		},
+		{
+			name:    "too many",
+			a:       Announcement{Endpoints: make([]*net.UDPAddr, MaxCandidates+1)},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.a.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Announcement.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_announcements(t *testing.T) {
+	keys := genKeys(t, 2)
+	now := time.Now()
+	a := Announcement{
+		Endpoints: []*net.UDPAddr{{IP: net.ParseIP("192.168.0.1"), Port: 51820}},
+	}
+	var as announcements
+	as.put(keys[0], a, now.Add(-time.Hour), time.Minute)
+	if _, ok := as.get(keys[0], now, time.Minute); ok {
+		t.Errorf("announcements.get() returned expired announcement")
+	}
+	as.put(keys[1], a, now, time.Minute)
+	if _, ok := as.m[keys[0]]; ok {
+		t.Errorf("announcements.put() did not remove expired announcement")
+	}
+	got, ok := as.get(keys[1], now, time.Minute)
+	if want := (announced{a.Endpoints, now}); !ok || !reflect.DeepEqual(got, want) {
+		t.Errorf("announcements.get() = %v, %v, want %v, true", got, ok, want)
+	}
+
+	var nilStore *announcements
+	if _, ok := nilStore.get(keys[1], now, time.Minute); ok {
+		t.Errorf("nil announcements.get() returned an announcement")
+	}
+}
+
+func TestRPC_Announce(t *testing.T) {
+	keys := genKeys(t, 1)
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest", wgtypes.Peer{PublicKey: keys[0]})
+	a := Announcement{
+		Endpoints: []*net.UDPAddr{{IP: net.ParseIP("192.168.0.1"), Port: 51820}},
+	}
+
+	s := &RPC{
+		device:      "wgtest",
+		wgc:         m,
+		announced:   new(announcements),
+		announceTTL: time.Minute,
+	}
+	if err := s.Announce(a, new(AnnounceReply)); !errors.Is(err, ErrNoCaller) {
+		t.Fatalf("RPC.Announce() error = %v, want %v", err, ErrNoCaller)
+	}
+
+	s.caller = &wgtypes.Peer{PublicKey: keys[0]}
+	rs := new(AnnounceReply)
+	if err := s.Announce(a, rs); err != nil {
+		t.Fatal(err)
+	}
+	if rs.TTL != time.Minute {
+		t.Errorf("RPC.Announce() TTL = %v, want %v", rs.TTL, time.Minute)
+	}
+
+	pm := new(PeerMap)
+	if err := s.Find(keys, pm); err != nil {
+		t.Fatal(err)
+	}
+	got := pm.Peers[keys[0]]
+	if got.Status != Found || !reflect.DeepEqual(got.Candidates, a.Endpoints) || got.Announced.IsZero() {
+		t.Errorf("RPC.Find() = %v, want Found with candidates %v", got, a.Endpoints)
+	}
+}
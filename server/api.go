@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Paths of the JSON APIs
+const (
+	// JSONRPCPath serves JSON-RPC 2.0 over HTTP POST, with method "RPC.Find"
+	// and params: an array of base64 encoded keys or {"keys": [...], "device": "wg0", "max_age": "5m"}.
+	JSONRPCPath = "/jsonrpc"
+	// FindPeersPath serves POST requests with body {"keys": [...], "device": "wg0", "max_age": "5m"}
+	// and responds with {"peers": {"<key>": {...}}}.
+	FindPeersPath = "/peers:find"
+	// PeersPath serves GET requests for a single peer on PeersPath + "<key>",
+	// with optional device and max_age query parameters.
+	// The key needs to be URL escaped or use the URL-safe base64 alphabet.
+	PeersPath = "/peers/"
+)
+
+// maxBodySize of JSON requests
+const maxBodySize = 1 << 20
+
+// findRequest is the body of a FindPeersPath request.
+// Device and MaxAge are optional, see RPC.FindDevice.
+type findRequest struct {
+	Keys   []string `json:"keys"`
+	Device string   `json:"device,omitempty"`
+	// MaxAge is a duration, like "5m"
+	MaxAge string `json:"max_age,omitempty"`
+}
+
+// request parses fr into a FindRequest
+func (fr *findRequest) request() (FindRequest, error) {
+	keys, err := parseKeys(fr.Keys)
+	if err != nil {
+		return FindRequest{}, err
+	}
+	rq := FindRequest{Device: fr.Device, Keys: keys}
+	if fr.MaxAge != "" {
+		if rq.MaxAge, err = time.ParseDuration(fr.MaxAge); err != nil {
+			return FindRequest{}, err
+		}
+	}
+	return rq, nil
+}
+
+// apiError is the body of JSON error responses
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// writeJSON responds v with status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveFindPeers serves the REST find request
+func serveFindPeers(w http.ResponseWriter, r *http.Request, rpcs *RPC) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+	var fr findRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&fr); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	rq, err := fr.request()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	var pm PeerMap
+	if err = rpcs.FindDevice(rq, &pm); err != nil {
+		writeJSON(w, findStatus(err), apiError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, newJSONPeerMap(&pm))
+}
+
+// serveGetPeer serves the REST request for a single peer
+func serveGetPeer(w http.ResponseWriter, r *http.Request, rpcs *RPC) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+	// Base64 keys may contain a (escaped) slash, so the escaped path is used
+	ks, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), PeersPath))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	q := r.URL.Query()
+	fr := findRequest{
+		Keys:   []string{ks},
+		Device: q.Get("device"),
+		MaxAge: q.Get("max_age"),
+	}
+	rq, err := fr.request()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+	var pm PeerMap
+	if err = rpcs.FindDevice(rq, &pm); err != nil {
+		writeJSON(w, findStatus(err), apiError{err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, pm.Peers[rq.Keys[0]])
+}
+
+// findStatus returns the HTTP status code for an error of FindDevice
+func findStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownDevice):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNegativeMaxAge):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrUnknownCaller), errors.Is(err, ErrDenied):
+		return http.StatusForbidden
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// JSON-RPC 2.0 error codes
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcServerError    = -32000
+)
+
+// jsonrpcRequest is a JSON-RPC 2.0 request object
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// jsonrpcResponse is a JSON-RPC 2.0 response object
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// jsonrpcError is a JSON-RPC 2.0 error object
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// serveJSONRPC serves JSON-RPC 2.0 requests, including batches
+func serveJSONRPC(w http.ResponseWriter, r *http.Request, rpcs *RPC) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{http.StatusText(http.StatusMethodNotAllowed)})
+		return
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&raw); err != nil {
+		writeJSON(w, http.StatusOK, jsonrpcFail(nil, jsonrpcParseError, err.Error()))
+		return
+	}
+	if raw = bytes.TrimSpace(raw); len(raw) == 0 || raw[0] != '[' {
+		if rs := callJSONRPC(raw, rpcs); rs != nil {
+			writeJSON(w, http.StatusOK, rs)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(raw, &batch); err != nil || len(batch) == 0 {
+		writeJSON(w, http.StatusOK, jsonrpcFail(nil, jsonrpcInvalidRequest, "Invalid batch"))
+		return
+	}
+	var rss []*jsonrpcResponse
+	for _, b := range batch {
+		if rs := callJSONRPC(b, rpcs); rs != nil {
+			rss = append(rss, rs)
+		}
+	}
+	if len(rss) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, rss)
+}
+
+// callJSONRPC handles a single JSON-RPC request object.
+// nil is returned for notifications, which have no id.
+func callJSONRPC(raw json.RawMessage, rpcs *RPC) *jsonrpcResponse {
+	var rq jsonrpcRequest
+	if err := json.Unmarshal(raw, &rq); err != nil || rq.JSONRPC != "2.0" || rq.Method == "" {
+		return jsonrpcFail(nil, jsonrpcInvalidRequest, "Invalid request")
+	}
+	rs := jsonrpcFail(rq.ID, jsonrpcMethodNotFound, "Method not found: "+rq.Method)
+	if rq.Method == "RPC.Find" {
+		rs = jsonrpcFind(rq, rpcs)
+	}
+	if rq.ID == nil {
+		return nil
+	}
+	return rs
+}
+
+// jsonrpcFind calls Find with the params of rq
+func jsonrpcFind(rq jsonrpcRequest, rpcs *RPC) *jsonrpcResponse {
+	var fr findRequest
+	if err := json.Unmarshal(rq.Params, &fr.Keys); err != nil {
+		if err = json.Unmarshal(rq.Params, &fr); err != nil {
+			return jsonrpcFail(rq.ID, jsonrpcInvalidParams, err.Error())
+		}
+	}
+	frq, err := fr.request()
+	if err != nil {
+		return jsonrpcFail(rq.ID, jsonrpcInvalidParams, err.Error())
+	}
+	var pm PeerMap
+	if err = rpcs.FindDevice(frq, &pm); err != nil {
+		if errors.Is(err, ErrNegativeMaxAge) {
+			return jsonrpcFail(rq.ID, jsonrpcInvalidParams, err.Error())
+		}
+		return jsonrpcFail(rq.ID, jsonrpcServerError, err.Error())
+	}
+	return &jsonrpcResponse{
+		JSONRPC: "2.0",
+		Result:  newJSONPeerMap(&pm),
+		ID:      rq.ID,
+	}
+}
+
+// jsonrpcFail returns an error response
+func jsonrpcFail(id json.RawMessage, code int, msg string) *jsonrpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &jsonrpcResponse{
+		JSONRPC: "2.0",
+		Error:   &jsonrpcError{code, msg},
+		ID:      id,
+	}
+}
@@ -0,0 +1,231 @@
+// +build unit
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func testAPIServer(t *testing.T) (*httptest.Server, []wgtypes.Key) {
+	keys := genKeys(t, 2)
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest", wgtypes.Peer{
+		PublicKey: keys[0],
+		Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 123},
+	})
+	h, err := newHandler("wgtest", &Server{Backend: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(h), keys
+}
+
+// The gob endpoint remains available next to the JSON APIs
+func TestAPI_gob(t *testing.T) {
+	ts, keys := testAPIServer(t)
+	defer ts.Close()
+	c, err := rpc.DialHTTP("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var pm PeerMap
+	if err = c.Call("RPC.Find", keys, &pm); err != nil {
+		t.Fatal(err)
+	}
+	if pm.Peers[keys[0]].Status != Found || pm.Peers[keys[1]].Status != NotFound {
+		t.Errorf("RPC.Find() = %v, want found and not found", pm.Peers)
+	}
+}
+
+func TestAPI_REST(t *testing.T) {
+	ts, keys := testAPIServer(t)
+	defer ts.Close()
+	found := `{"status":"found","public_key":"` + keys[0].String() + `","endpoint":"192.168.0.1:123"}`
+	notFound := `{"status":"not_found","public_key":"` + keys[1].String() + `"}`
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "get peer",
+			method:   http.MethodGet,
+			path:     PeersPath + url.PathEscape(keys[0].String()),
+			wantCode: http.StatusOK,
+			wantBody: found,
+		},
+		{
+			name:     "get unknown peer",
+			method:   http.MethodGet,
+			path:     PeersPath + url.PathEscape(keys[1].String()),
+			wantCode: http.StatusOK,
+			wantBody: notFound,
+		},
+		{
+			// The endpoint has no handshake, so its age is unknown
+			name:     "get peer max age",
+			method:   http.MethodGet,
+			path:     PeersPath + url.PathEscape(keys[0].String()) + "?max_age=1m",
+			wantCode: http.StatusOK,
+			wantBody: `{"status":"no_endpoint","public_key":"` + keys[0].String() + `"}`,
+		},
+		{
+			name:     "get bogus max age",
+			method:   http.MethodGet,
+			path:     PeersPath + url.PathEscape(keys[0].String()) + "?max_age=foo",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "get bogus key",
+			method:   http.MethodGet,
+			path:     PeersPath + "foo",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "put peer",
+			method:   http.MethodPut,
+			path:     PeersPath + url.PathEscape(keys[0].String()),
+			wantCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:     "find peers",
+			method:   http.MethodPost,
+			path:     FindPeersPath,
+			body:     `{"keys":["` + keys[0].String() + `","` + keys[1].String() + `"]}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"peers":{"` + keys[0].String() + `":` + found + `,"` + keys[1].String() + `":` + notFound + `}}`,
+		},
+		{
+			name:     "find negative max age",
+			method:   http.MethodPost,
+			path:     FindPeersPath,
+			body:     `{"keys":["` + keys[0].String() + `"],"max_age":"-1m"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "find bogus body",
+			method:   http.MethodPost,
+			path:     FindPeersPath,
+			body:     `{"keys":`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "not found",
+			method:   http.MethodGet,
+			path:     "/foo",
+			wantCode: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testAPIRequest(t, ts, tt.method, tt.path, tt.body, tt.wantCode, tt.wantBody)
+		})
+	}
+}
+
+func TestAPI_JSONRPC(t *testing.T) {
+	ts, keys := testAPIServer(t)
+	defer ts.Close()
+	result := `{"peers":{"` + keys[0].String() + `":{"status":"found","public_key":"` + keys[0].String() + `","endpoint":"192.168.0.1:123"}}}`
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "positional params",
+			body:     `{"jsonrpc":"2.0","method":"RPC.Find","params":["` + keys[0].String() + `"],"id":1}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"jsonrpc":"2.0","result":` + result + `,"id":1}`,
+		},
+		{
+			name:     "named params",
+			body:     `{"jsonrpc":"2.0","method":"RPC.Find","params":{"keys":["` + keys[0].String() + `"]},"id":"a"}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"jsonrpc":"2.0","result":` + result + `,"id":"a"}`,
+		},
+		{
+			name:     "batch",
+			body:     `[{"jsonrpc":"2.0","method":"RPC.Find","params":["` + keys[0].String() + `"],"id":1},{"jsonrpc":"2.0","method":"foo","id":2}]`,
+			wantCode: http.StatusOK,
+			wantBody: `[{"jsonrpc":"2.0","result":` + result + `,"id":1},{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found: foo"},"id":2}]`,
+		},
+		{
+			name:     "notification",
+			body:     `{"jsonrpc":"2.0","method":"RPC.Find","params":[]}`,
+			wantCode: http.StatusNoContent,
+		},
+		{
+			name:     "invalid params",
+			body:     `{"jsonrpc":"2.0","method":"RPC.Find","params":["foo"],"id":1}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid key \"foo\": wgtypes: failed to parse base64-encoded key: illegal base64 data at input byte 0"},"id":1}`,
+		},
+		{
+			name:     "invalid request",
+			body:     `{"method":"RPC.Find","id":1}`,
+			wantCode: http.StatusOK,
+			wantBody: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid request"},"id":null}`,
+		},
+		{
+			name:     "parse error",
+			body:     `{`,
+			wantCode: http.StatusOK,
+			wantBody: `{"jsonrpc":"2.0","error":{"code":-32700,"message":"unexpected EOF"},"id":null}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testAPIRequest(t, ts, http.MethodPost, JSONRPCPath, tt.body, tt.wantCode, tt.wantBody)
+		})
+	}
+}
+
+// testAPIRequest checks the status code and the JSON body, if wantBody is set
+func testAPIRequest(t *testing.T, ts *httptest.Server, method, path, body string, wantCode int, wantBody string) {
+	rq, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := http.DefaultClient.Do(rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+	got, err := ioutil.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.StatusCode != wantCode {
+		t.Errorf("%s %s status = %d, want %d; body: %s", method, path, rs.StatusCode, wantCode, got)
+	}
+	if wantBody == "" {
+		return
+	}
+	var g, w interface{}
+	if err = json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("%s %s body %s: %v", method, path, got, err)
+	}
+	if err = json.Unmarshal([]byte(wantBody), &w); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("%s %s body = \n%s\n, want \n%s\n", method, path, got, wantBody)
+	}
+}
@@ -0,0 +1,361 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// DefaultSessionTTL is the lifetime of session tokens.
+const DefaultSessionTTL = 10 * time.Minute
+
+const (
+	// challengeTTL is the time a challenge can be answered in
+	challengeTTL = 30 * time.Second
+	// maxChallenges is the number of unanswered challenges kept by a Server
+	maxChallenges = 1024
+	// maxAddrChallenges is the number of unanswered challenges kept for a remote address
+	maxAddrChallenges = 16
+	// maxKeyChallenges is the number of unanswered challenges kept for a public key from a remote address,
+	// a new challenge replaces the oldest one
+	maxKeyChallenges = 4
+	// proofContext separates the proofs of this protocol from other uses of the keys
+	proofContext = "wire-directory challenge v1"
+)
+
+var (
+	// ErrUnauthenticated is returned when the caller needs to authenticate first, see RPC.Challenge
+	ErrUnauthenticated = errors.New("authentication required")
+	// ErrAuthFailed is returned for a wrong proof, an unknown or expired challenge
+	// and an unknown or expired session token
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrAuthDisabled is returned by Challenge and Authenticate when the Server has no Auth
+	ErrAuthDisabled = errors.New("authentication disabled")
+	// ErrTooManyChallenges is returned by Challenge when too many challenges
+	// of the remote address or the Server are unanswered
+	ErrTooManyChallenges = errors.New("too many pending challenges")
+)
+
+// Auth configures the authentication of callers by their WireGuard key.
+// A caller proves the possession of the private key of a device peer
+// with a challenge-response handshake, see RPC.Challenge,
+// and is then identified by that key, instead of its remote address.
+type Auth struct {
+	// SessionTTL is the lifetime of the session tokens of Authenticate.
+	// DefaultSessionTTL is used when zero.
+	SessionTTL time.Duration
+	// Required rejects callers which are not authenticated,
+	// also when their remote address is an allowed IP of a peer.
+	Required bool
+}
+
+// sessionTTL returns the configured or default SessionTTL
+func (a *Auth) sessionTTL() time.Duration {
+	if a.SessionTTL > 0 {
+		return a.SessionTTL
+	}
+	return DefaultSessionTTL
+}
+
+// ChallengeRequest is the argument of Challenge
+type ChallengeRequest struct {
+	// PublicKey of the peer to authenticate as
+	PublicKey wgtypes.Key
+}
+
+// Challenge to prove the possession of the private key of a peer, see Prove
+type Challenge struct {
+	Device string
+	// PublicKey of the challenged peer
+	PublicKey wgtypes.Key
+	// ServerKey is the ephemeral public key of the directory for this challenge
+	ServerKey wgtypes.Key
+	Nonce     []byte
+	// Expires is the time until the challenge can be answered
+	Expires time.Time
+}
+
+// Prove the possession of priv, the private key of the challenged peer.
+// The proof is the HMAC-SHA256 of the challenge,
+// keyed with the X25519 shared secret of priv and the ServerKey.
+func (c *Challenge) Prove(priv wgtypes.Key) ([]byte, error) {
+	if priv.PublicKey() != c.PublicKey {
+		return nil, errors.New("private key does not match the challenged key")
+	}
+	shared, err := x25519(priv, c.ServerKey)
+	if err != nil {
+		return nil, err
+	}
+	return c.mac(shared), nil
+}
+
+// mac returns the HMAC of c, keyed with the shared secret
+func (c *Challenge) mac(shared []byte) []byte {
+	m := hmac.New(sha256.New, shared)
+	for _, b := range [][]byte{[]byte(proofContext), []byte(c.Device), c.PublicKey[:], c.ServerKey[:], c.Nonce} {
+		// Length prefixed, so that the fields can not be shifted
+		m.Write([]byte{byte(len(b) >> 8), byte(len(b))})
+		m.Write(b)
+	}
+	return m.Sum(nil)
+}
+
+// x25519 returns the shared secret of a private and public key
+func x25519(priv, pub wgtypes.Key) ([]byte, error) {
+	k, err := ecdh.X25519().NewPrivateKey(priv[:])
+	if err != nil {
+		return nil, err
+	}
+	p, err := ecdh.X25519().NewPublicKey(pub[:])
+	if err != nil {
+		return nil, err
+	}
+	return k.ECDH(p)
+}
+
+// AuthRequest answers a Challenge, it is the argument of Authenticate
+type AuthRequest struct {
+	Nonce []byte
+	// Proof computed by Challenge.Prove
+	Proof []byte
+}
+
+// Session of an authenticated caller
+type Session struct {
+	// Token authenticates HTTP requests and RPC connections in an
+	// "Authorization: Bearer <token>" header, until it Expires.
+	Token   string
+	Expires time.Time
+}
+
+// pending is an unanswered challenge with the ephemeral private key of the directory
+// and the remote address it was sent to
+type pending struct {
+	c    Challenge
+	priv wgtypes.Key
+	addr string
+}
+
+type session struct {
+	key     wgtypes.Key
+	expires time.Time
+}
+
+// sessions keeps the pending challenges and the sessions of a Server.
+// The zero value is ready to use.
+type sessions struct {
+	mu         sync.Mutex
+	challenges map[string]pending
+	tokens     map[string]session
+}
+
+// challenge stores c sent to the remote addr, to be answered before it expires.
+// The number of challenges is limited per addr, so that a caller can not exhaust
+// the challenges of the Server, and per public key from addr,
+// so that a caller can not block the authentication of a peer from another address.
+func (ss *sessions) challenge(c Challenge, priv wgtypes.Key, addr string, now time.Time) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.challenges == nil {
+		ss.challenges = make(map[string]pending)
+	}
+	var (
+		perAddr, perKey int
+		oldest          string
+	)
+	for n, p := range ss.challenges {
+		if now.After(p.c.Expires) {
+			delete(ss.challenges, n)
+			continue
+		}
+		if p.addr != addr {
+			continue
+		}
+		perAddr++
+		if p.c.PublicKey == c.PublicKey {
+			perKey++
+			if oldest == "" || p.c.Expires.Before(ss.challenges[oldest].c.Expires) {
+				oldest = n
+			}
+		}
+	}
+	if perKey >= maxKeyChallenges {
+		delete(ss.challenges, oldest)
+	} else if perAddr >= maxAddrChallenges || len(ss.challenges) >= maxChallenges {
+		return ErrTooManyChallenges
+	}
+	ss.challenges[string(c.Nonce)] = pending{c, priv, addr}
+	return nil
+}
+
+// answer removes and returns the challenge with nonce, if it did not expire
+func (ss *sessions) answer(nonce []byte, now time.Time) (pending, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	p, ok := ss.challenges[string(nonce)]
+	delete(ss.challenges, string(nonce))
+	return p, ok && !now.After(p.c.Expires)
+}
+
+// create a session for key, valid during ttl
+func (ss *sessions) create(key wgtypes.Key, ttl time.Duration, now time.Time) (Session, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return Session{}, err
+	}
+	s := Session{
+		Token:   base64.RawURLEncoding.EncodeToString(b),
+		Expires: now.Add(ttl),
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.tokens == nil {
+		ss.tokens = make(map[string]session)
+	}
+	for t, x := range ss.tokens {
+		if now.After(x.expires) {
+			delete(ss.tokens, t)
+		}
+	}
+	ss.tokens[s.Token] = session{key, s.Expires}
+	return s, nil
+}
+
+// get the key of the session with token, if it did not expire
+func (ss *sessions) get(token string, now time.Time) (wgtypes.Key, bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	x, ok := ss.tokens[token]
+	if !ok || now.After(x.expires) {
+		return wgtypes.Key{}, false
+	}
+	return x.key, true
+}
+
+// bearerToken returns the token of the Authorization header of r
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) <= len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return "", false
+	}
+	return h[len(prefix):], true
+}
+
+// identity returns the caller, or ErrUnauthenticated when the caller needs to authenticate first
+func (s *RPC) identity() (*wgtypes.Peer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.needAuth {
+		return nil, ErrUnauthenticated
+	}
+	return s.caller, nil
+}
+
+// peer returns the caller, which may be nil
+func (s *RPC) peer() *wgtypes.Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.caller
+}
+
+// authenticated returns the key the caller authenticated with, or nil
+func (s *RPC) authenticated() *wgtypes.Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authKey
+}
+
+// Challenge starts the authentication of the caller as the device peer with rq.PublicKey.
+// Implements a net.RPC method.
+//
+// The directory replies with an ephemeral public key and a nonce.
+// The caller proves the possession of the peer's private key with Challenge.Prove
+// and answers with Authenticate before the challenge expires.
+// Authentication needs to be enabled on the Server, see Auth.
+func (s *RPC) Challenge(rq ChallengeRequest, rs *Challenge) (err error) {
+	defer s.done("Challenge", time.Now(), &err)
+	if s.sessions == nil {
+		return ErrAuthDisabled
+	}
+	dev, err := s.wgc.Device(s.device)
+	if err != nil {
+		return err
+	}
+	if _, ok := peerByKey(dev.Peers, rq.PublicKey); !ok {
+		return ErrUnknownCaller
+	}
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 32)
+	if _, err = rand.Read(nonce); err != nil {
+		return err
+	}
+	now := time.Now()
+	c := Challenge{
+		Device:    s.device,
+		PublicKey: rq.PublicKey,
+		ServerKey: priv.PublicKey(),
+		Nonce:     nonce,
+		Expires:   now.Add(challengeTTL),
+	}
+	var addr string
+	if s.remote != nil {
+		addr = s.remote.IP.String()
+	}
+	if err = s.sessions.challenge(c, priv, addr, now); err != nil {
+		return err
+	}
+	*rs = c
+	return nil
+}
+
+// Authenticate answers a Challenge. Implements a net.RPC method.
+// A challenge can only be answered once.
+//
+// On success, the other calls on the RPC connection are made as the challenged peer,
+// and a Session is returned, which authenticates new connections and HTTP requests.
+func (s *RPC) Authenticate(rq AuthRequest, rs *Session) (err error) {
+	defer s.done("Authenticate", time.Now(), &err)
+	if s.sessions == nil {
+		return ErrAuthDisabled
+	}
+	now := time.Now()
+	p, ok := s.sessions.answer(rq.Nonce, now)
+	if !ok || p.c.Device != s.device {
+		return ErrAuthFailed
+	}
+	shared, err := x25519(p.priv, p.c.PublicKey)
+	if err != nil || !hmac.Equal(rq.Proof, p.c.mac(shared)) {
+		return ErrAuthFailed
+	}
+	dev, err := s.wgc.Device(s.device)
+	if err != nil {
+		return err
+	}
+	caller, ok := peerByKey(dev.Peers, p.c.PublicKey)
+	if !ok {
+		return ErrUnknownCaller
+	}
+	if s.acl != nil && !s.acl.permits(caller.PublicKey) {
+		return ErrDenied
+	}
+	if *rs, err = s.sessions.create(caller.PublicKey, s.sessionTTL, now); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.caller, s.authKey, s.needAuth = &caller, &caller.PublicKey, false
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,256 @@
+// +build unit
+
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestChallenge_Prove(t *testing.T) {
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := Challenge{
+		Device:    "wgtest",
+		PublicKey: priv.PublicKey(),
+		ServerKey: server.PublicKey(),
+		Nonce:     []byte("nonce"),
+	}
+	proof, err := c.Prove(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Computed by the directory with its ephemeral key
+	shared, err := x25519(server, c.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(proof) != string(c.mac(shared)) {
+		t.Error("Prove() does not match the directory's proof")
+	}
+	c.Device = "wgother"
+	if string(proof) == string(c.mac(shared)) {
+		t.Error("Prove() does not depend on the device")
+	}
+	if _, err = c.Prove(server); err == nil {
+		t.Error("Prove() expected error for a private key of another peer")
+	}
+}
+
+func TestRPC_Authenticate(t *testing.T) {
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPriv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := otherPriv.PublicKey()
+	m := NewMemoryBackend()
+	// No allowed IPs, the caller can only be identified by authentication
+	m.SetPeers("wgtest", wgtypes.Peer{PublicKey: priv.PublicKey()}, wgtypes.Peer{PublicKey: other})
+	srv := &Server{
+		Backend: m,
+		ACL:     &ACL{Deny: []wgtypes.Key{other}},
+		Auth:    &Auth{SessionTTL: time.Minute},
+	}
+	srv.ifaceIPs = loopbackIPs
+	h, err := newHandler("wgtest", srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	c, err := rpc.DialHTTP("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Call("RPC.Find", []wgtypes.Key{other}, new(PeerMap)); err == nil || err.Error() != ErrUnauthenticated.Error() {
+		t.Fatalf("RPC.Find() error = %v, want %v", err, ErrUnauthenticated)
+	}
+	if err = c.Call("RPC.Challenge", ChallengeRequest{PublicKey: genKeys(t, 1)[0]}, new(Challenge)); err == nil {
+		t.Error("RPC.Challenge() expected error for unknown peer")
+	}
+
+	// Wrong proof
+	var ch Challenge
+	if err = c.Call("RPC.Challenge", ChallengeRequest{PublicKey: priv.PublicKey()}, &ch); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Call("RPC.Authenticate", AuthRequest{Nonce: ch.Nonce, Proof: []byte("foo")}, new(Session)); err == nil || err.Error() != ErrAuthFailed.Error() {
+		t.Errorf("RPC.Authenticate() error = %v, want %v", err, ErrAuthFailed)
+	}
+	// The challenge is spent
+	proof, err := ch.Prove(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Call("RPC.Authenticate", AuthRequest{Nonce: ch.Nonce, Proof: proof}, new(Session)); err == nil {
+		t.Error("RPC.Authenticate() expected error for a spent challenge")
+	}
+
+	if err = c.Call("RPC.Challenge", ChallengeRequest{PublicKey: priv.PublicKey()}, &ch); err != nil {
+		t.Fatal(err)
+	}
+	if proof, err = ch.Prove(priv); err != nil {
+		t.Fatal(err)
+	}
+	var s Session
+	if err = c.Call("RPC.Authenticate", AuthRequest{Nonce: ch.Nonce, Proof: proof}, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Token == "" || time.Until(s.Expires) > time.Minute {
+		t.Errorf("RPC.Authenticate() = %v, want a token valid for a minute", s)
+	}
+	var r Reflection
+	if err = c.Call("RPC.WhoAmI", struct{}{}, &r); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Known || r.PublicKey != priv.PublicKey() {
+		t.Errorf("RPC.WhoAmI() = %v, want the authenticated peer", r)
+	}
+
+	body := `{"keys":["` + other.String() + `"]}`
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+	}{
+		{"session", s.Token, http.StatusOK},
+		{"no session", "", http.StatusForbidden},
+		{"unknown session", "foo", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rq, err := http.NewRequest(http.MethodPost, ts.URL+FindPeersPath, strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				rq.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rs, err := http.DefaultClient.Do(rq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rs.Body.Close()
+			if rs.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d", rs.StatusCode, tt.wantCode)
+			}
+		})
+	}
+
+	// Denied peers can not authenticate
+	if err = c.Call("RPC.Challenge", ChallengeRequest{PublicKey: other}, &ch); err != nil {
+		t.Fatal(err)
+	}
+	if proof, err = ch.Prove(otherPriv); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Call("RPC.Authenticate", AuthRequest{Nonce: ch.Nonce, Proof: proof}, &s); err == nil {
+		t.Error("RPC.Authenticate() expected error for denied peer")
+	}
+}
+
+func TestAuth_Required(t *testing.T) {
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest")
+	h, err := newHandler("wgtest", &Server{Backend: m, Auth: &Auth{Required: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, FindPeersPath, strings.NewReader(`{"keys":[]}`)))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("status = %d, want %d with challenge", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_sessions(t *testing.T) {
+	var ss sessions
+	now := time.Now()
+	key := genKeys(t, 1)[0]
+	s, err := ss.create(key, time.Minute, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := ss.get(s.Token, now); !ok || got != key {
+		t.Errorf("get() = %v, %v, want %v", got, ok, key)
+	}
+	if _, ok := ss.get(s.Token, now.Add(2*time.Minute)); ok {
+		t.Error("get() returned expired session")
+	}
+
+	for i := 0; i < maxChallenges; i++ {
+		c := Challenge{Nonce: []byte{byte(i), byte(i >> 8)}, Expires: now.Add(time.Second)}
+		if err = ss.challenge(c, wgtypes.Key{}, strconv.Itoa(i), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = ss.challenge(Challenge{Nonce: []byte("foo"), Expires: now.Add(time.Second)}, wgtypes.Key{}, "foo", now); err != ErrTooManyChallenges {
+		t.Errorf("challenge() error = %v, want %v", err, ErrTooManyChallenges)
+	}
+	// Expired challenges are dropped
+	if err = ss.challenge(Challenge{Nonce: []byte("foo")}, wgtypes.Key{}, "foo", now.Add(2*time.Second)); err != nil {
+		t.Errorf("challenge() error = %v", err)
+	}
+	if _, ok := ss.answer([]byte("foo"), now.Add(3*time.Second)); ok {
+		t.Error("answer() returned expired challenge")
+	}
+}
+
+func Test_sessions_challengeLimits(t *testing.T) {
+	var ss sessions
+	now := time.Now()
+	keys := genKeys(t, maxAddrChallenges+1)
+	challenge := func(i int, key wgtypes.Key, addr string) error {
+		c := Challenge{
+			PublicKey: key,
+			Nonce:     []byte(addr + strconv.Itoa(i)),
+			Expires:   now.Add(time.Second + time.Duration(i)),
+		}
+		return ss.challenge(c, wgtypes.Key{}, addr, now)
+	}
+
+	// A new challenge of a key replaces the oldest one from the same address
+	for i := 0; i <= maxKeyChallenges; i++ {
+		if err := challenge(i, keys[0], "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := ss.answer([]byte("10.0.0.10"), now); ok {
+		t.Error("answer() returned replaced challenge")
+	}
+	if _, ok := ss.answer([]byte("10.0.0.11"), now); !ok {
+		t.Error("answer() did not return pending challenge")
+	}
+
+	// Other keys are limited per address
+	for i := maxKeyChallenges - 1; i < maxAddrChallenges; i++ {
+		if err := challenge(100+i, keys[i], "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := challenge(200, keys[maxAddrChallenges], "10.0.0.1"); err != ErrTooManyChallenges {
+		t.Errorf("challenge() error = %v, want %v", err, ErrTooManyChallenges)
+	}
+	if err := challenge(200, keys[0], "10.0.0.2"); err != nil {
+		t.Errorf("challenge() error = %v from another address", err)
+	}
+}
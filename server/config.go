@@ -7,20 +7,19 @@ import (
 )
 
 // Configure the RPC server. If addrs is not specified, it defaults on listening
-// on all available addresses on device.
+// on all available addresses on device. The listeners then follow the address changes
+// of device while the server is running. A device without addresses or that does not exist (yet)
+// is not an error in that case.
 //
 // Device is also used by this package for the WireGuard specific queries.
 // Those queries will fail if device is not a WG interface or does not exist.
 // However, this is not a considered an error for Configure.
 // Use addrs if you want the RPC server to listen on different addresses as the WG device.
+//
+// More devices can be served by the same server with AddDevice.
 func Configure(device string, port uint16, addrs ...string) (*Server, error) {
-	tcas, err := tcpAddrs(device, port, addrs...)
-	if err != nil {
-		return nil, err
-	}
 	s := new(Server)
-	s.listeners, err = httpServers(device, tcas)
-	if err != nil {
+	if err := s.AddDevice(device, port, addrs...); err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -87,11 +86,12 @@ func tcpAddrs(name string, port uint16, addrs ...string) ([]net.TCPAddr, error)
 	return tcas, nil
 }
 
-// httpServers configures multiple listeners with new RPC objects for each TCPAddr
-func httpServers(device string, tcas []net.TCPAddr) ([]*http.Server, error) {
+// httpServers configures multiple listeners with a new RPC handler for each TCPAddr.
+// All handlers share the settings of srv.
+func httpServers(device string, tcas []net.TCPAddr, srv *Server) ([]*http.Server, error) {
 	var servers []*http.Server
 	for _, a := range tcas {
-		rpc, err := NewRPC(device)
+		h, err := newHandler(device, srv)
 		if err != nil {
 			return nil, err
 		}
@@ -99,7 +99,7 @@ func httpServers(device string, tcas []net.TCPAddr) ([]*http.Server, error) {
 			servers,
 			&http.Server{
 				Addr:    a.String(),
-				Handler: rpc,
+				Handler: h,
 			},
 		)
 	}
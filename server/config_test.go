@@ -220,7 +220,7 @@ func Test_httpServers(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := httpServers(tt.args.device, tt.args.tcas)
+			got, err := httpServers(tt.args.device, tt.args.tcas, new(Server))
 			if (err != nil) != tt.wantErr {
 				t.Errorf("httpServers() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -256,7 +256,7 @@ func TestConfigure(t *testing.T) {
 				port:   123,
 			},
 			want: &Server{
-				[]*http.Server{
+				listeners: []*http.Server{
 					{
 						Addr: "127.0.0.1:123",
 					},
@@ -274,7 +274,7 @@ func TestConfigure(t *testing.T) {
 				addrs:  []string{"192.168.0.1", "::2"},
 			},
 			want: &Server{
-				[]*http.Server{
+				listeners: []*http.Server{
 					{
 						Addr: "192.168.0.1:456",
 					},
@@ -290,6 +290,15 @@ func TestConfigure(t *testing.T) {
 				device: "foo",
 				port:   789,
 			},
+			want: &Server{},
+		},
+		{
+			name: "Bogus address",
+			args: args{
+				device: "foo",
+				port:   789,
+				addrs:  []string{"foo"},
+			},
 			wantErr: true,
 		},
 	}
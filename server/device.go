@@ -0,0 +1,232 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	// ErrDeviceExists is returned by AddDevice for a device that is already served
+	ErrDeviceExists = errors.New("device exists")
+	// ErrUnknownDevice is returned for requests scoped to a device the Server does not serve
+	ErrUnknownDevice = errors.New("device not served")
+)
+
+// device served by a Server
+type device struct {
+	name string
+	port uint16
+	// follow the addresses of the device with its listeners
+	follow bool
+	// discovered devices are removed when they disappear, see ConfigureAll
+	discovered bool
+}
+
+// stores of the state a Server keeps per device.
+// Announcements and gossip records only apply to the peers of one device
+// and are never served on another.
+type stores struct {
+	announced announcements
+	records   records
+}
+
+// deviceStores returns the stores of device name, created when missing.
+// Unlike the served devices, stores are also available for devices only known to the Backend.
+func (s *Server) deviceStores(name string) *stores {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stores == nil {
+		s.stores = make(map[string]*stores)
+	}
+	st, ok := s.stores[name]
+	if !ok {
+		st = new(stores)
+		s.stores[name] = st
+	}
+	return st
+}
+
+// deviceLister lists the WireGuard devices of the system.
+// It is implemented by *wgctrl.Client and MemoryBackend.
+type deviceLister interface {
+	Devices() ([]*wgtypes.Device, error)
+}
+
+// ConfigureAll configures a RPC server for all WireGuard devices of the system,
+// listening on port on all addresses of each device.
+// The devices are discovered when ListenAndServe is called and on every address or link change,
+// see WatchInterval. Listeners of new devices are started, those of removed devices closed.
+//
+// The Backend of the server is used for the discovery, when it implements
+// Devices() ([]*wgtypes.Device, error) like *wgctrl.Client and MemoryBackend do.
+// Devices with a different port or addresses can be added by AddDevice.
+func ConfigureAll(port uint16) *Server {
+	return &Server{
+		discover: true,
+		port:     port,
+		follow:   true,
+	}
+}
+
+// AddDevice adds a WireGuard device to the server, with listeners like Configure.
+// If addrs is not specified, the listeners follow the addresses of the device on port.
+// Requests are answered for the device of the listener they are made on,
+// unless they are scoped to another served device, see RPC.FindDevice.
+//
+// Must be called before ListenAndServe.
+func (s *Server) AddDevice(name string, port uint16, addrs ...string) error {
+	tcas, err := tcpAddrs(name, port, addrs...)
+	if err != nil {
+		if addrs != nil {
+			return err
+		}
+		s.logger().Warn("device addresses unavailable, waiting for addresses", "device", name, "error", err)
+	}
+	hs, err := httpServers(name, tcas, s)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.checkDevice(name, hs); err != nil {
+		for _, l := range hs {
+			l.Handler.(*handler).close()
+		}
+		return err
+	}
+	s.devices = append(s.devices, &device{
+		name:   name,
+		port:   port,
+		follow: addrs == nil,
+	})
+	s.follow = s.follow || addrs == nil
+	s.listeners = append(s.listeners, hs...)
+	return nil
+}
+
+// checkDevice returns an error if device name or one of its listeners exists. s.mu must be held.
+func (s *Server) checkDevice(name string, hs []*http.Server) error {
+	if s.closed {
+		return http.ErrServerClosed
+	}
+	if s.findDevice(name) != nil {
+		return fmt.Errorf("%s: %w", name, ErrDeviceExists)
+	}
+	for _, l := range hs {
+		if s.findListener(l.Addr) != nil {
+			return fmt.Errorf("%s: %w", l.Addr, ErrListenerExists)
+		}
+	}
+	return nil
+}
+
+// findDevice returns the served device with name, or nil. s.mu must be held.
+func (s *Server) findDevice(name string) *device {
+	for _, d := range s.devices {
+		if d.name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// Devices returns the names of the WireGuard devices served by the Server.
+//
+// Safe to call while ListenAndServe is running.
+func (s *Server) Devices() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, len(s.devices))
+	for i, d := range s.devices {
+		names[i] = d.name
+	}
+	return names
+}
+
+// serves reports whether device name is served by s
+func (s *Server) serves(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.findDevice(name) != nil
+}
+
+// firstDevice returns the name of the first served device, or "" when there is none.
+// s.mu must be held.
+func (s *Server) firstDevice() string {
+	if len(s.devices) == 0 {
+		return ""
+	}
+	return s.devices[0].name
+}
+
+// listDevices returns the sorted names of the WireGuard devices of the system,
+// from the Backend of s or a new wgctrl client when it is nil.
+func (s *Server) listDevices() ([]string, error) {
+	var dl deviceLister
+	switch b := s.Backend.(type) {
+	case nil:
+		wgc, err := wgctrl.New()
+		if err != nil {
+			return nil, err
+		}
+		defer wgc.Close()
+		dl = wgc
+	case deviceLister:
+		dl = b
+	default:
+		return nil, fmt.Errorf("backend %T does not list devices", b)
+	}
+	devs, err := dl.Devices()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(devs))
+	for i, d := range devs {
+		names[i] = d.Name
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// discoverDevices updates the served devices to the WireGuard devices of the system.
+// Devices which were not discovered are not affected.
+func (s *Server) discoverDevices() error {
+	names, err := s.listDevices()
+	if err != nil {
+		return fmt.Errorf("discover devices: %w", err)
+	}
+	found := make(map[string]bool, len(names))
+	for _, n := range names {
+		found[n] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keep []*device
+	for _, d := range s.devices {
+		if !d.discovered || found[d.name] {
+			keep = append(keep, d)
+			continue
+		}
+		s.logger().Info("device removed", "device", d.name)
+		delete(s.stores, d.name)
+	}
+	s.devices = keep
+	for _, n := range names {
+		if s.findDevice(n) != nil {
+			continue
+		}
+		s.logger().Info("device discovered", "device", n)
+		s.devices = append(s.devices, &device{
+			name:       n,
+			port:       s.port,
+			follow:     true,
+			discovered: true,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+// +build unit
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestServer_AddDevice(t *testing.T) {
+	s, err := Configure("wga", 9000, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddDevice("wgb", 9001, "127.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.AddDevice("wga", 9002, "127.0.0.1"); !errors.Is(err, ErrDeviceExists) {
+		t.Errorf("AddDevice() error = %v, want %v", err, ErrDeviceExists)
+	}
+	if err = s.AddDevice("wgc", 9000, "127.0.0.1"); !errors.Is(err, ErrListenerExists) {
+		t.Errorf("AddDevice() error = %v, want %v", err, ErrListenerExists)
+	}
+	if got, want := s.Devices(), []string{"wga", "wgb"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Devices() = %v, want %v", got, want)
+	}
+	got := make(map[string]string)
+	for _, l := range s.listeners {
+		got[l.Addr] = listenerDevice(l)
+	}
+	want := map[string]string{"127.0.0.1:9000": "wga", "127.0.0.1:9001": "wgb"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listener devices = %v, want %v", got, want)
+	}
+}
+
+func TestConfigureAll(t *testing.T) {
+	m := NewMemoryBackend()
+	// A fake WireGuard device with the addresses of the loopback interface
+	m.SetPeers("lo")
+	s := ConfigureAll(9300)
+	s.Backend = m
+	// Devices of the backend are discovered by polling
+	s.WatchInterval = 10 * time.Millisecond
+	s.addrEvents = func(context.Context) (<-chan struct{}, error) {
+		return nil, errors.New("no notifications")
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- s.ListenAndServe()
+	}()
+	defer func() {
+		s.Close()
+		<-ec
+		waitFree(t, "127.0.0.1:9300", "[::1]:9300")
+	}()
+	waitAddrs(t, s, 2)
+	if got := s.Devices(); !reflect.DeepEqual(got, []string{"lo"}) {
+		t.Errorf("Devices() = %v, want [lo]", got)
+	}
+	if err := s.Ready(); err != nil {
+		t.Errorf("Ready() error = %v", err)
+	}
+
+	m.RemoveDevice("lo")
+	waitAddrs(t, s, 0)
+	if got := s.Devices(); len(got) != 0 {
+		t.Errorf("Devices() = %v, want none", got)
+	}
+	if err := s.Ready(); err != ErrNoDevices {
+		t.Errorf("Ready() error = %v, want %v", err, ErrNoDevices)
+	}
+}
+
+func TestConfigureAll_backend(t *testing.T) {
+	s := ConfigureAll(9000)
+	s.Backend = struct{ Backend }{NewMemoryBackend()}
+	if err := s.rebind(); err == nil {
+		t.Error("rebind() expected error for a backend without Devices")
+	}
+}
+
+func TestRPC_FindDevice(t *testing.T) {
+	keys := genKeys(t, 3)
+	local := []net.IPNet{{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(32, 32)}}
+	m := NewMemoryBackend()
+	m.SetPeers("wga", wgtypes.Peer{PublicKey: keys[0], AllowedIPs: local})
+	m.SetPeers("wgb",
+		wgtypes.Peer{PublicKey: keys[1], AllowedIPs: local},
+		wgtypes.Peer{PublicKey: keys[2]},
+	)
+	m.SetPeers("wgc", wgtypes.Peer{PublicKey: keys[2]})
+	srv := &Server{
+		Backend: m,
+		ACL:     new(ACL),
+		devices: []*device{{name: "wga"}, {name: "wgb"}, {name: "wgc"}},
+	}
+	srv.ifaceIPs = loopbackIPs
+	h, err := newHandler("wga", srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	// Scoped by the listener
+	c, err := rpc.DialHTTP("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var pm PeerMap
+	if err = c.Call("RPC.Find", keys[2:], &pm); err != nil {
+		t.Fatal(err)
+	}
+	if got := pm.Peers[keys[2]].Status; got != NotFound {
+		t.Errorf("RPC.Find() status = %v, want %v", got, NotFound)
+	}
+	if err = c.Call("RPC.FindDevice", FindRequest{Device: "wgb", Keys: keys[2:]}, &pm); err != nil {
+		t.Fatal(err)
+	}
+	if got := pm.Peers[keys[2]].Status; got != NoEndpoint {
+		t.Errorf("RPC.FindDevice() status = %v, want %v", got, NoEndpoint)
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{
+		{"listener device", `{"keys":["` + keys[0].String() + `"]}`, http.StatusOK},
+		{"served device", `{"keys":["` + keys[2].String() + `"],"device":"wgb"}`, http.StatusOK},
+		{"caller not a peer", `{"keys":["` + keys[2].String() + `"],"device":"wgc"}`, http.StatusForbidden},
+		{"unknown device", `{"keys":["` + keys[2].String() + `"],"device":"wgd"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testAPIRequest(t, ts, http.MethodPost, FindPeersPath, tt.body, tt.wantCode, "")
+		})
+	}
+}
+
+func TestServer_deviceStores(t *testing.T) {
+	keys := genKeys(t, 2)
+	now := time.Now()
+	ep := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 51820}
+	m := NewMemoryBackend()
+	m.SetPeers("wga", wgtypes.Peer{PublicKey: keys[0]})
+	m.SetPeers("wgb", wgtypes.Peer{PublicKey: keys[0]})
+	srv := &Server{
+		Backend: m,
+		Gossip:  true,
+		devices: []*device{{name: "wga"}, {name: "wgb"}},
+	}
+	h, err := newHandler("wga", srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodConnect, "/_goRPC_", nil)
+	caller := &wgtypes.Peer{PublicKey: keys[0]}
+
+	srv.MergeRecords("wga", keys[0], []Record{{PublicKey: keys[1], Endpoint: ep, Observed: now, Observer: keys[0]}})
+	if got := srv.Records("wga"); len(got) != 1 {
+		t.Errorf("Server.Records(wga) = %v, want 1 record", got)
+	}
+	if got := srv.Records("wgb"); len(got) != 0 {
+		t.Errorf("Server.Records(wgb) = %v, want none", got)
+	}
+	a := Announcement{Endpoints: []*net.UDPAddr{ep}}
+	if err = h.newRPC("wga", r, caller).Announce(a, new(AnnounceReply)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]Status{"wga": Found, "wgb": NotFound}
+	for device, st := range want {
+		pm := new(PeerMap)
+		if err = h.newRPC(device, r, caller).Find(keys, pm); err != nil {
+			t.Fatal(err)
+		}
+		if got := pm.Peers[keys[1]].Status; got != st {
+			t.Errorf("RPC.Find() on %s status = %v, want %v", device, got, st)
+		}
+		if got := pm.Peers[keys[0]].Candidates; (got != nil) != (st == Found) {
+			t.Errorf("RPC.Find() on %s candidates = %v", device, got)
+		}
+	}
+}
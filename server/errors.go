@@ -0,0 +1,72 @@
+package server
+
+import (
+	"strings"
+)
+
+// ListenerError is the error of the listener on Addr
+type ListenerError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ListenerError) Error() string {
+	return e.Addr + ": " + e.Err.Error()
+}
+
+func (e *ListenerError) Unwrap() error {
+	return e.Err
+}
+
+// Errors of multiple listeners, returned by Close, Shutdown and ListenAndServe.
+// errors.Is and errors.As match any of the listener errors, for example:
+//
+//	var le *ListenerError
+//	if errors.As(err, &le) && errors.Is(le, syscall.EADDRINUSE) { ... }
+type Errors []*ListenerError
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, le := range e {
+		msgs[i] = le.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns the listener errors, for errors.Is and errors.As
+func (e Errors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, le := range e {
+		errs[i] = le
+	}
+	return errs
+}
+
+// add the error of the listener on addr, replacing a previous error of addr
+func (e Errors) add(addr string, err error) Errors {
+	for _, le := range e {
+		if le.Addr == addr {
+			le.Err = err
+			return e
+		}
+	}
+	return append(e, &ListenerError{Addr: addr, Err: err})
+}
+
+// remove the error of the listener on addr
+func (e Errors) remove(addr string) Errors {
+	for i, le := range e {
+		if le.Addr == addr {
+			return append(e[:i:i], e[i+1:]...)
+		}
+	}
+	return e
+}
+
+// err returns e as error, or nil when empty
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
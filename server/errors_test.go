@@ -0,0 +1,107 @@
+// +build unit
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestErrors(t *testing.T) {
+	errFoo := errors.New("foo")
+	var errs Errors
+	errs = errs.add("127.0.0.1:9000", errors.New("bar"))
+	errs = errs.add("[::1]:9000", errFoo)
+	errs = errs.add("127.0.0.1:9000", http.ErrServerClosed)
+
+	if got, want := errs.Error(), "127.0.0.1:9000: http: Server closed; [::1]:9000: foo"; got != want {
+		t.Errorf("Errors.Error() = %q, want %q", got, want)
+	}
+	var err error = errs
+	if !errors.Is(err, errFoo) || !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("errors.Is(%v) = false", err)
+	}
+	var le *ListenerError
+	if !errors.As(err, &le) || le.Addr != "127.0.0.1:9000" {
+		t.Errorf("errors.As(%v) = %v", err, le)
+	}
+	if Errors(nil).err() != nil {
+		t.Error("empty Errors.err() != nil")
+	}
+	errs = errs.remove("127.0.0.1:9000")
+	if got, want := errs.Error(), "[::1]:9000: foo"; got != want {
+		t.Errorf("Errors.remove() = %q, want %q", got, want)
+	}
+}
+
+func TestServer_ListenAndServe_errors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &Server{
+		listeners: []*http.Server{
+			{Addr: "127.0.0.1:9000"},
+			{Addr: ln.Addr().String()},
+		},
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- s.ListenAndServe()
+	}()
+	select {
+	case err = <-ec:
+	case <-time.After(5 * time.Second):
+		s.Close()
+		t.Fatal("ListenAndServe() did not return")
+	}
+	var errs Errors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Addr != ln.Addr().String() {
+		t.Fatalf("ListenAndServe() error = %v, want Errors of %s", err, ln.Addr())
+	}
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("ListenAndServe() error = %v, want %v", err, syscall.EADDRINUSE)
+	}
+}
+
+func TestServer_ListenAndServe_shutdownAfterFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9302")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Server)
+	if err = s.AddListener("127.0.0.1:9302"); err != nil {
+		t.Fatal(err)
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- s.ListenAndServe()
+	}()
+	waitAddrs(t, s, 0)
+
+	// The address is free again, the listener is added back
+	ln.Close()
+	if err = s.AddListener("127.0.0.1:9302"); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, s, "127.0.0.1:9302", Serving)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-ec:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() did not return")
+	}
+	if err != http.ErrServerClosed {
+		t.Errorf("ListenAndServe() error = %v, want %v", err, http.ErrServerClosed)
+	}
+}
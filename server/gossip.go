@@ -0,0 +1,215 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MaxRecordAge is the age after which gossiped records are dropped
+const MaxRecordAge = time.Hour
+
+// maxClockSkew tolerated on the observation time of received records
+const maxClockSkew = time.Minute
+
+// ErrGossipDisabled is returned by the Gossip RPC when gossip is not enabled on the Server
+var ErrGossipDisabled = errors.New("gossip disabled")
+
+// Record of an endpoint observation, exchanged between directories by gossip.
+type Record struct {
+	// PublicKey of the peer
+	PublicKey wgtypes.Key
+	// Endpoint of the peer
+	Endpoint *net.UDPAddr
+	// Observed is the time of the handshake on Endpoint
+	Observed time.Time
+	// Observer is the public key of the WireGuard device which had the handshake
+	Observer wgtypes.Key
+	// Signature of the observing directory, see Sign and TrustList.
+	// Empty when the record is not signed.
+	Signature []byte
+}
+
+// valid reports if r is usable at time now
+func (r *Record) valid(now time.Time) bool {
+	return r.Endpoint != nil && r.Observed.Before(now.Add(maxClockSkew)) && now.Sub(r.Observed) <= MaxRecordAge
+}
+
+// DeviceRecords returns a Record for every peer of dev with an endpoint and a handshake
+func DeviceRecords(dev *wgtypes.Device) []Record {
+	var rs []Record
+	for _, p := range dev.Peers {
+		if r, ok := deviceRecord(dev, p); ok {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// deviceRecord returns the Record of the observation of p by dev,
+// if p has an endpoint and a handshake
+func deviceRecord(dev *wgtypes.Device, p wgtypes.Peer) (Record, bool) {
+	if p.Endpoint == nil || p.LastHandshakeTime.IsZero() {
+		return Record{}, false
+	}
+	return Record{
+		PublicKey: p.PublicKey,
+		Endpoint:  p.Endpoint,
+		Observed:  p.LastHandshakeTime,
+		Observer:  dev.PublicKey,
+	}, true
+}
+
+// records stores the most recent Record by peer key (last writer wins).
+// The zero value is ready to use and it is safe for concurrent use.
+// A nil *records stores nothing.
+type records struct {
+	mu sync.Mutex
+	m  map[wgtypes.Key]Record
+}
+
+// merge rs into the store. Records which are invalid at now,
+// or older than the stored record of the same key are ignored.
+// Observation times after now are clamped to now, so that a record from
+// the future can not win over the observations to come.
+// The signature of a clamped record no longer matches and is removed.
+// Expired records are removed.
+func (s *records) merge(rs []Record, now time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(map[wgtypes.Key]Record)
+	}
+	for k, r := range s.m {
+		if !r.valid(now) {
+			delete(s.m, k)
+		}
+	}
+	for _, r := range rs {
+		if !r.valid(now) {
+			continue
+		}
+		if r.Observed.After(now) {
+			r.Observed, r.Signature = now, nil
+		}
+		if cur, ok := s.m[r.PublicKey]; !ok || r.Observed.After(cur.Observed) {
+			s.m[r.PublicKey] = r
+		}
+	}
+}
+
+// get the Record of key, if it exists and is valid at now
+func (s *records) get(key wgtypes.Key, now time.Time) (Record, bool) {
+	if s == nil {
+		return Record{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.m[key]
+	if !ok || !r.valid(now) {
+		return Record{}, false
+	}
+	return r, true
+}
+
+// all valid records at now
+func (s *records) all(now time.Time) []Record {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rs := make([]Record, 0, len(s.m))
+	for _, r := range s.m {
+		if r.valid(now) {
+			rs = append(rs, r)
+		}
+	}
+	return rs
+}
+
+// received returns the records of rs which are accepted from the directory of peer from.
+// With trust, those signed by a trusted observer.
+// Otherwise the observer can not be verified and only the observations of from itself are accepted.
+func received(rs []Record, from wgtypes.Key, trust TrustList) []Record {
+	if trust != nil {
+		return trust.Records(rs)
+	}
+	own := make([]Record, 0, len(rs))
+	for _, r := range rs {
+		if r.Observer == from {
+			own = append(own, r)
+		}
+	}
+	return own
+}
+
+// MergeRecords received from the directory of peer from into the gossip view of device,
+// with last writer wins semantics. Used to store the replies of Gossip calls to other directories.
+// Records of Private peers are dropped, see Disclosure.
+// With a Trust list the records which are not signed by a trusted observer are dropped,
+// otherwise those which are not observed by from.
+func (s *Server) MergeRecords(device string, from wgtypes.Key, rs []Record) {
+	s.deviceStores(device).records.merge(received(s.Disclosure.Records(rs), from, s.Trust), time.Now())
+}
+
+// Observations returns the records of the observations of dev which may be disclosed,
+// signed with the SigningKey. Used to send the device observations of this directory by gossip.
+func (s *Server) Observations(dev *wgtypes.Device) []Record {
+	return signRecords(s.Disclosure.Records(DeviceRecords(dev)), s.SigningKey)
+}
+
+// Records returns the gossip view of device, without the records of Private peers
+func (s *Server) Records(device string) []Record {
+	return s.Disclosure.Records(s.deviceStores(device).records.all(time.Now()))
+}
+
+// Gossip merges the records of the calling directory and replies with the records
+// of this directory: its device observations, merged with the gossip view.
+// Implements a net.RPC method.
+//
+// Only the records of peers visible to the caller are returned, see Server.SetPolicy,
+// and never those of Private peers, see Disclosure.
+// With a Trust list on the Server, received records which are not signed by a trusted observer are dropped.
+// Without, only the observations of the caller itself are accepted.
+// Gossip needs to be enabled on the Server and the caller is identified by access control,
+// ErrNoCaller is returned if it is disabled.
+func (s *RPC) Gossip(rq []Record, rs *[]Record) (err error) {
+	defer s.done("Gossip", time.Now(), &err)
+	if s.records == nil {
+		return ErrGossipDisabled
+	}
+	caller, err := s.identity()
+	if err != nil {
+		return err
+	}
+	if caller == nil {
+		return ErrNoCaller
+	}
+	dev, err := s.wgc.Device(s.device)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.records.merge(received(s.disclosure.Records(rq), caller.PublicKey, s.trust), now)
+	var view records
+	view.merge(s.records.all(now), now)
+	view.merge(signRecords(DeviceRecords(dev), s.signingKey), now)
+	*rs = s.disclosure.Records(view.all(now))
+	if policy := s.currentPolicy(); policy != nil {
+		visible := (*rs)[:0]
+		for _, r := range *rs {
+			if policy.visible(caller, r.PublicKey) {
+				visible = append(visible, r)
+			}
+		}
+		*rs = visible
+	}
+	return nil
+}
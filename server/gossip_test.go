@@ -0,0 +1,126 @@
+// +build unit
+
+package server
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestDeviceRecords(t *testing.T) {
+	keys := genKeys(t, 3)
+	now := time.Now()
+	ep := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 123}
+	dev := &wgtypes.Device{
+		PublicKey: keys[0],
+		Peers: []wgtypes.Peer{
+			{PublicKey: keys[1], Endpoint: ep, LastHandshakeTime: now},
+			{PublicKey: keys[2], Endpoint: ep},
+		},
+	}
+	want := []Record{
+		{PublicKey: keys[1], Endpoint: ep, Observed: now, Observer: keys[0]},
+	}
+	if got := DeviceRecords(dev); !reflect.DeepEqual(got, want) {
+		t.Errorf("DeviceRecords() = %v, want %v", got, want)
+	}
+}
+
+func Test_records_merge(t *testing.T) {
+	keys := genKeys(t, 3)
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}
+	b := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 2}
+	var s records
+	s.merge([]Record{
+		{PublicKey: keys[0], Endpoint: a, Observed: now.Add(-time.Minute)},
+		{PublicKey: keys[1], Endpoint: a, Observed: now},
+	}, now)
+	s.merge([]Record{
+		// Newer wins
+		{PublicKey: keys[0], Endpoint: b, Observed: now},
+		// Older loses
+		{PublicKey: keys[1], Endpoint: b, Observed: now.Add(-time.Minute)},
+		// Invalid records are ignored
+		{PublicKey: keys[2], Observed: now},
+		{PublicKey: keys[2], Endpoint: b, Observed: now.Add(time.Hour)},
+		{PublicKey: keys[2], Endpoint: b, Observed: now.Add(-2 * MaxRecordAge)},
+	}, now)
+	// Future observations are clamped and can not win from later ones
+	s.merge([]Record{
+		{PublicKey: keys[2], Endpoint: a, Observed: now.Add(maxClockSkew / 2), Signature: []byte("foo")},
+	}, now)
+	s.merge([]Record{
+		{PublicKey: keys[2], Endpoint: b, Observed: now.Add(time.Second)},
+	}, now.Add(time.Second))
+	want := map[wgtypes.Key]Record{
+		keys[0]: {PublicKey: keys[0], Endpoint: b, Observed: now},
+		keys[1]: {PublicKey: keys[1], Endpoint: a, Observed: now},
+		keys[2]: {PublicKey: keys[2], Endpoint: b, Observed: now.Add(time.Second)},
+	}
+	if !reflect.DeepEqual(s.m, want) {
+		t.Errorf("records.merge() = %v, want %v", s.m, want)
+	}
+	// Records expire
+	s.merge(nil, now.Add(2*MaxRecordAge))
+	if len(s.m) != 0 {
+		t.Errorf("records.merge() = %v, want expired", s.m)
+	}
+}
+
+func TestRPC_Gossip(t *testing.T) {
+	keys := genKeys(t, 4)
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}
+	b := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 2}
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: keys[1], Endpoint: a, LastHandshakeTime: now.Add(-time.Minute)},
+	)
+	s := &RPC{
+		device: "wgtest",
+		wgc:    m,
+	}
+	if err := s.Gossip(nil, new([]Record)); !errors.Is(err, ErrGossipDisabled) {
+		t.Fatalf("RPC.Gossip() error = %v, want %v", err, ErrGossipDisabled)
+	}
+	s.records = new(records)
+	if err := s.Gossip(nil, new([]Record)); !errors.Is(err, ErrNoCaller) {
+		t.Fatalf("RPC.Gossip() error = %v, want %v", err, ErrNoCaller)
+	}
+	s.caller = &wgtypes.Peer{PublicKey: keys[0]}
+
+	rq := []Record{
+		// Newer than the device's observation
+		{PublicKey: keys[1], Endpoint: b, Observed: now, Observer: keys[0]},
+		// Unknown to the device
+		{PublicKey: keys[2], Endpoint: b, Observed: now, Observer: keys[0]},
+		// Not observed by the caller, dropped without trust list
+		{PublicKey: keys[3], Endpoint: b, Observed: now, Observer: keys[2]},
+	}
+	var rs []Record
+	if err := s.Gossip(rq, &rs); err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 2 {
+		t.Errorf("RPC.Gossip() = %v, want %v", rs, rq[:2])
+	}
+
+	pm := new(PeerMap)
+	if err := s.Find(keys[1:], pm); err != nil {
+		t.Fatal(err)
+	}
+	want := map[wgtypes.Key]Peer{
+		keys[1]: {Status: Found, PublicKey: keys[1], Endpoint: b, LastHandshakeTime: now, Observer: keys[0]},
+		keys[2]: {Status: Found, PublicKey: keys[2], Endpoint: b, LastHandshakeTime: now, Observer: keys[0]},
+		keys[3]: {Status: NotFound, PublicKey: keys[3]},
+	}
+	if !reflect.DeepEqual(pm.Peers, want) {
+		t.Errorf("RPC.Find() = \n%v\n, want \n%v\n", pm.Peers, want)
+	}
+}
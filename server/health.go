@@ -0,0 +1,102 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Health endpoints, served on every listener without access control.
+const (
+	// HealthzPath reports if the Server is serving, see Server.Healthy
+	HealthzPath = "/healthz"
+	// ReadyzPath reports if the WireGuard device of the listener is readable, see Server.Ready
+	ReadyzPath = "/readyz"
+)
+
+var (
+	// ErrNoListeners is returned by Healthy when the Server has no listeners
+	ErrNoListeners = errors.New("no listeners")
+	// ErrNotServing is returned by Healthy when none of the listeners of the Server is serving
+	ErrNotServing = errors.New("no listener serving")
+	// ErrNoDevices is returned by Ready when the Server has no devices
+	ErrNoDevices = errors.New("no devices")
+)
+
+// Healthy returns nil when at least one listener of the Server is serving,
+// so that a retrying listener does not fail the other ones.
+// It also returns nil while ListenAndServe follows the addresses of a device which has none yet.
+func (s *Server) Healthy() error {
+	ls := s.Listeners()
+	for _, l := range ls {
+		if l.State == Serving {
+			return nil
+		}
+	}
+	if len(ls) > 0 {
+		return ErrNotServing
+	}
+	s.mu.Lock()
+	waiting := s.serving && s.follow
+	s.mu.Unlock()
+	if waiting {
+		return nil
+	}
+	return ErrNoListeners
+}
+
+// Ready returns nil when all WireGuard devices of the Server can be read.
+func (s *Server) Ready() error {
+	devices := s.Devices()
+	if len(devices) == 0 {
+		return ErrNoDevices
+	}
+	var errs []error
+	for _, d := range devices {
+		if err := s.ready(d, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ready returns an error when device cannot be read from b, see readDevice
+func (s *Server) ready(device string, b Backend) error {
+	if _, err := s.readDevice(device, b); err != nil {
+		return fmt.Errorf("device %s: %w", device, err)
+	}
+	return nil
+}
+
+// readDevice from b. The Backend of s, or a new wgctrl client is used when b is nil.
+func (s *Server) readDevice(device string, b Backend) (*wgtypes.Device, error) {
+	if b == nil {
+		b = s.Backend
+	}
+	if b == nil {
+		wgc, err := wgctrl.New()
+		if err != nil {
+			return nil, err
+		}
+		defer wgc.Close()
+		b = wgc
+	}
+	return b.Device(device)
+}
+
+// serveHealth writes "ok" when check returns nil.
+// Otherwise only the status is written, the error is logged:
+// the health endpoints are served without access control.
+func (h *handler) serveHealth(w http.ResponseWriter, r *http.Request, check func() error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := check(); err != nil {
+		h.srv.logger().Debug("health check failed", "path", r.URL.Path, "device", h.device, "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, http.StatusText(http.StatusServiceUnavailable))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,108 @@
+// +build unit
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest")
+	srv := &Server{
+		Backend: m,
+		ACL:     new(ACL),
+	}
+	h, err := newHandler("wgtest", srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code, strings.TrimSpace(w.Body.String())
+	}
+
+	// No listeners, the error is not disclosed
+	unavailable := http.StatusText(http.StatusServiceUnavailable)
+	if code, body := get(HealthzPath); code != http.StatusServiceUnavailable || body != unavailable {
+		t.Errorf("healthz = %d %s, want %d %s", code, body, http.StatusServiceUnavailable, unavailable)
+	}
+	if err := srv.AddListener("127.0.0.1:9000"); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := get(HealthzPath); code != http.StatusServiceUnavailable {
+		t.Errorf("healthz = %d for idle listener, want %d", code, http.StatusServiceUnavailable)
+	}
+	go srv.ListenAndServe()
+	defer srv.Close()
+	waitState(t, srv, "127.0.0.1:9000", Serving)
+	if code, body := get(HealthzPath); code != http.StatusOK || body != "ok" {
+		t.Errorf("healthz = %d %s, want %d ok", code, body, http.StatusOK)
+	}
+
+	// Served without access control, unlike the RPC endpoints
+	if code, body := get(ReadyzPath); code != http.StatusOK || body != "ok" {
+		t.Errorf("readyz = %d %s, want %d ok", code, body, http.StatusOK)
+	}
+	if code, _ := get(MetricsPath); code != http.StatusForbidden && code != http.StatusBadRequest {
+		t.Errorf("metrics = %d, want access denied", code)
+	}
+
+	m.RemoveDevice("wgtest")
+	if code, body := get(ReadyzPath); code != http.StatusServiceUnavailable || body != unavailable {
+		t.Errorf("readyz = %d %s for missing device, want %d %s", code, body, http.StatusServiceUnavailable, unavailable)
+	}
+}
+
+func TestServer_Healthy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := &Server{
+		Retry: &Retry{Delay: time.Hour},
+		listeners: []*http.Server{
+			{Addr: ln.Addr().String()},
+			{Addr: "127.0.0.1:9301"},
+		},
+	}
+	if err := s.Healthy(); err != ErrNotServing {
+		t.Errorf("Healthy() = %v for idle listeners, want %v", err, ErrNotServing)
+	}
+	go s.ListenAndServe()
+	defer s.Close()
+	waitState(t, s, ln.Addr().String(), Retrying)
+	waitState(t, s, "127.0.0.1:9301", Serving)
+	if err := s.Healthy(); err != nil {
+		t.Errorf("Healthy() = %v with a retrying listener, want nil", err)
+	}
+
+	// Following a device without addresses
+	f := &Server{follow: true}
+	if err := f.Healthy(); err != ErrNoListeners {
+		t.Errorf("Healthy() = %v before ListenAndServe, want %v", err, ErrNoListeners)
+	}
+	f.serving = true
+	if err := f.Healthy(); err != nil {
+		t.Errorf("Healthy() = %v while following, want nil", err)
+	}
+}
+
+func TestServer_Ready(t *testing.T) {
+	m := NewMemoryBackend()
+	s := &Server{Backend: m, devices: []*device{{name: "wgtest"}}}
+	if err := s.Ready(); err == nil {
+		t.Error("Ready() expected error for missing device")
+	}
+	m.SetPeers("wgtest")
+	if err := s.Ready(); err != nil {
+		t.Errorf("Ready() error = %v", err)
+	}
+}
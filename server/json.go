@@ -0,0 +1,200 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MarshalText implements encoding.TextMarshaler, for JSON encoding
+func (s Status) MarshalText() ([]byte, error) {
+	switch s {
+	case NotFound, NoEndpoint, Found, NotVisible:
+		return []byte(strings.Replace(s.String(), " ", "_", -1)), nil
+	default:
+		return nil, fmt.Errorf("Invalid status: %d", int(s))
+	}
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler, for JSON decoding
+func (s *Status) UnmarshalText(text []byte) error {
+	for _, v := range []Status{NotFound, NoEndpoint, Found, NotVisible} {
+		if t, _ := v.MarshalText(); string(t) == string(text) {
+			*s = v
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid status: %s", text)
+}
+
+// jsonPeer is the JSON representation of Peer.
+// Keys are base64 encoded, addresses in string notation.
+type jsonPeer struct {
+	Status            Status     `json:"status"`
+	PublicKey         string     `json:"public_key"`
+	Endpoint          string     `json:"endpoint,omitempty"`
+	LastHandshakeTime *time.Time `json:"last_handshake_time,omitempty"`
+	AllowedIPs        []string   `json:"allowed_ips,omitempty"`
+	Candidates        []string   `json:"candidates,omitempty"`
+	Announced         *time.Time `json:"announced,omitempty"`
+	Observer          string     `json:"observer,omitempty"`
+	Record            *Record    `json:"record,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (p Peer) MarshalJSON() ([]byte, error) {
+	jp := jsonPeer{
+		Status:    p.Status,
+		PublicKey: p.PublicKey.String(),
+	}
+	if p.Endpoint != nil {
+		jp.Endpoint = p.Endpoint.String()
+	}
+	if !p.LastHandshakeTime.IsZero() {
+		jp.LastHandshakeTime = &p.LastHandshakeTime
+	}
+	for _, n := range p.AllowedIPs {
+		jp.AllowedIPs = append(jp.AllowedIPs, n.String())
+	}
+	for _, c := range p.Candidates {
+		jp.Candidates = append(jp.Candidates, c.String())
+	}
+	if !p.Announced.IsZero() {
+		jp.Announced = &p.Announced
+	}
+	if p.Observer != (wgtypes.Key{}) {
+		jp.Observer = p.Observer.String()
+	}
+	jp.Record = p.Record
+	return json.Marshal(jp)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (p *Peer) UnmarshalJSON(data []byte) error {
+	var jp jsonPeer
+	if err := json.Unmarshal(data, &jp); err != nil {
+		return err
+	}
+	dp := Peer{Status: jp.Status}
+	var err error
+	if dp.PublicKey, err = wgtypes.ParseKey(jp.PublicKey); err != nil {
+		return err
+	}
+	if jp.Endpoint != "" {
+		if dp.Endpoint, err = net.ResolveUDPAddr("udp", jp.Endpoint); err != nil {
+			return err
+		}
+	}
+	if jp.LastHandshakeTime != nil {
+		dp.LastHandshakeTime = *jp.LastHandshakeTime
+	}
+	for _, s := range jp.AllowedIPs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return err
+		}
+		dp.AllowedIPs = append(dp.AllowedIPs, *n)
+	}
+	for _, s := range jp.Candidates {
+		c, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			return err
+		}
+		dp.Candidates = append(dp.Candidates, c)
+	}
+	if jp.Announced != nil {
+		dp.Announced = *jp.Announced
+	}
+	if jp.Observer != "" {
+		if dp.Observer, err = wgtypes.ParseKey(jp.Observer); err != nil {
+			return err
+		}
+	}
+	dp.Record = jp.Record
+	*p = dp
+	return nil
+}
+
+// jsonRecord is the JSON representation of Record.
+// Keys and the signature are base64 encoded, the endpoint in string notation.
+type jsonRecord struct {
+	PublicKey string    `json:"public_key"`
+	Endpoint  string    `json:"endpoint,omitempty"`
+	Observed  time.Time `json:"observed"`
+	Observer  string    `json:"observer"`
+	Signature []byte    `json:"signature,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler
+func (r Record) MarshalJSON() ([]byte, error) {
+	jr := jsonRecord{
+		PublicKey: r.PublicKey.String(),
+		Observed:  r.Observed,
+		Observer:  r.Observer.String(),
+		Signature: r.Signature,
+	}
+	if r.Endpoint != nil {
+		jr.Endpoint = r.Endpoint.String()
+	}
+	return json.Marshal(jr)
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (r *Record) UnmarshalJSON(data []byte) error {
+	var jr jsonRecord
+	if err := json.Unmarshal(data, &jr); err != nil {
+		return err
+	}
+	dr := Record{
+		Observed:  jr.Observed,
+		Signature: jr.Signature,
+	}
+	var err error
+	if dr.PublicKey, err = wgtypes.ParseKey(jr.PublicKey); err != nil {
+		return err
+	}
+	if dr.Observer, err = wgtypes.ParseKey(jr.Observer); err != nil {
+		return err
+	}
+	if jr.Endpoint != "" {
+		if dr.Endpoint, err = net.ResolveUDPAddr("udp", jr.Endpoint); err != nil {
+			return err
+		}
+	}
+	*r = dr
+	return nil
+}
+
+// jsonPeerMap is the JSON representation of PeerMap, with base64 encoded keys
+type jsonPeerMap struct {
+	Peers map[string]Peer `json:"peers"`
+}
+
+func newJSONPeerMap(pm *PeerMap) jsonPeerMap {
+	jpm := jsonPeerMap{
+		Peers: make(map[string]Peer, len(pm.Peers)),
+	}
+	for k, p := range pm.Peers {
+		jpm.Peers[k.String()] = p
+	}
+	return jpm
+}
+
+// parseKeys parses base64 encoded keys.
+// The URL-safe base64 alphabet is accepted as well.
+func parseKeys(ss []string) ([]wgtypes.Key, error) {
+	keys := make([]wgtypes.Key, len(ss))
+	for i, s := range ss {
+		s = strings.NewReplacer("-", "+", "_", "/").Replace(s)
+		k, err := wgtypes.ParseKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid key %q: %w", ss[i], err)
+		}
+		keys[i] = k
+	}
+	return keys, nil
+}
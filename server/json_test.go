@@ -0,0 +1,92 @@
+// +build unit
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeer_JSON(t *testing.T) {
+	keys := genKeys(t, 2)
+	_, ipn, _ := net.ParseCIDR("10.0.0.1/32")
+	now := time.Now().UTC().Round(time.Second)
+	tests := []struct {
+		name string
+		p    Peer
+		want string
+	}{
+		{
+			name: "not found",
+			p:    Peer{PublicKey: keys[0]},
+			want: `{"status":"not_found","public_key":"` + keys[0].String() + `"}`,
+		},
+		{
+			name: "not visible",
+			p:    Peer{Status: NotVisible, PublicKey: keys[0]},
+			want: `{"status":"not_visible","public_key":"` + keys[0].String() + `"}`,
+		},
+		{
+			name: "all fields",
+			p: Peer{
+				Status:            Found,
+				PublicKey:         keys[0],
+				Endpoint:          &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51820},
+				LastHandshakeTime: now,
+				AllowedIPs:        []net.IPNet{*ipn},
+				Candidates:        []*net.UDPAddr{{IP: net.ParseIP("192.168.0.1").To4(), Port: 51820}},
+				Announced:         now,
+				Observer:          keys[1],
+			},
+			want: `{"status":"found","public_key":"` + keys[0].String() + `","endpoint":"[2001:db8::1]:51820",` +
+				`"last_handshake_time":"` + now.Format(time.RFC3339) + `","allowed_ips":["10.0.0.1/32"],` +
+				`"candidates":["192.168.0.1:51820"],"announced":"` + now.Format(time.RFC3339) + `",` +
+				`"observer":"` + keys[1].String() + `"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(tt.p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Peer.MarshalJSON() = \n%s\n, want \n%s\n", got, tt.want)
+			}
+			var p Peer
+			if err = json.Unmarshal(got, &p); err != nil {
+				t.Fatal(err)
+			}
+			// IP addresses may change representation, so compare the encoding again
+			if again, _ := json.Marshal(p); string(again) != tt.want {
+				t.Errorf("Peer.UnmarshalJSON() = \n%v\n, want \n%v\n", p, tt.p)
+			}
+		})
+	}
+}
+
+func Test_parseKeys(t *testing.T) {
+	keys := genKeys(t, 1)
+	std := keys[0].String()
+	urlSafe := []byte(std)
+	for i, c := range urlSafe {
+		switch c {
+		case '+':
+			urlSafe[i] = '-'
+		case '/':
+			urlSafe[i] = '_'
+		}
+	}
+	got, err := parseKeys([]string{std, string(urlSafe)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0] != keys[0] || got[1] != keys[0] {
+		t.Errorf("parseKeys() = %v, want %v twice", got, keys[0])
+	}
+	if _, err = parseKeys([]string{"foo"}); err == nil {
+		t.Errorf("parseKeys() error = nil, want error")
+	}
+}
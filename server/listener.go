@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+var (
+	// ErrListenerExists is returned by AddListener for an address that already has a listener
+	ErrListenerExists = errors.New("listener exists")
+	// ErrListenerNotFound is returned by RemoveListener for an address without listener
+	ErrListenerNotFound = errors.New("listener not found")
+)
+
+// ListenerState is the state of a listener
+type ListenerState int
+
+// Listener states
+const (
+	// Idle listeners are not started yet, by ListenAndServe
+	Idle ListenerState = iota
+	// Starting listeners are binding their address
+	Starting
+	// Serving listeners accept connections
+	Serving
+	// Retrying listeners failed and wait for a retry, see Server.Retry
+	Retrying
+)
+
+func (s ListenerState) String() string {
+	switch s {
+	case Idle:
+		return "idle"
+	case Starting:
+		return "starting"
+	case Serving:
+		return "serving"
+	case Retrying:
+		return "retrying"
+	default:
+		return fmt.Sprintf("ListenerState(%d)", int(s))
+	}
+}
+
+// ListenerStatus describes a listener, as returned by Server.Listeners
+type ListenerStatus struct {
+	// Addr the listener is configured with
+	Addr  string
+	State ListenerState
+	// Bound is the address the listener is bound to, nil when not Serving
+	Bound net.Addr
+	// Err is the last error of a Retrying listener
+	Err error
+	// Added is true for listeners added by AddListener.
+	// Other listeners are configured or follow the addresses of the device.
+	Added bool
+}
+
+// listenerState is kept for the listeners of a Server
+type listenerState struct {
+	state ListenerState
+	bound net.Addr
+	err   error
+	added bool
+}
+
+// setState of l, if it is still a listener of s
+func (s *Server) setState(l *http.Server, state ListenerState, bound net.Addr, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.states[l]; ok {
+		st.state, st.bound, st.err = state, bound, err
+	}
+}
+
+// listenerState returns the state of l, which is created if needed. s.mu must be held.
+func (s *Server) listenerState(l *http.Server) *listenerState {
+	st, ok := s.states[l]
+	if !ok {
+		if s.states == nil {
+			s.states = make(map[*http.Server]*listenerState)
+		}
+		st = new(listenerState)
+		s.states[l] = st
+	}
+	return st
+}
+
+// findListener returns the listener on addr, or nil. s.mu must be held.
+func (s *Server) findListener(addr string) *http.Server {
+	for _, l := range s.listeners {
+		if l.Addr == addr {
+			return l
+		}
+	}
+	return nil
+}
+
+// listenerAddr normalizes a host:port address, like the listeners of Configure
+func listenerAddr(addr string) (string, error) {
+	tca, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	return tca.String(), nil
+}
+
+// AddListener adds a listener on addr (host:port), serving the first device of the Server.
+// Requests for other devices can be scoped to them, see RPC.FindDevice.
+// It is started immediately when ListenAndServe is running,
+// which then keeps running until Close or Shutdown is called.
+// Added listeners are not affected by address changes of the device.
+//
+// Safe to call while ListenAndServe is running.
+func (s *Server) AddListener(addr string) error {
+	addr, err := listenerAddr(addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return http.ErrServerClosed
+	}
+	if s.findListener(addr) != nil {
+		return fmt.Errorf("%s: %w", addr, ErrListenerExists)
+	}
+	h, err := newHandler(s.firstDevice(), s)
+	if err != nil {
+		return err
+	}
+	l := &http.Server{
+		Addr:    addr,
+		Handler: h,
+	}
+	s.listeners = append(s.listeners, l)
+	s.listenerState(l).added = true
+	s.logger().Info("listener added", "addr", addr)
+	s.dynamic = true
+	if s.serving {
+		s.start(l)
+	}
+	return nil
+}
+
+// RemoveListener on addr (host:port). The listener is shut down gracefully,
+// open connections are closed when ctx is done, see http.Server.Shutdown.
+// A listener following the addresses of the device is restored on the next address change.
+//
+// Safe to call while ListenAndServe is running.
+func (s *Server) RemoveListener(ctx context.Context, addr string) error {
+	addr, err := listenerAddr(addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	l := s.findListener(addr)
+	if l != nil {
+		s.removeListener(l)
+	}
+	s.mu.Unlock()
+	if l == nil {
+		return fmt.Errorf("%s: %w", addr, ErrListenerNotFound)
+	}
+
+	if err = l.Shutdown(ctx); err != nil {
+		s.logger().Warn("listener shutdown failed", "addr", l.Addr, "error", err)
+		err = l.Close()
+	}
+	if h, ok := l.Handler.(*handler); ok {
+		h.close()
+	}
+	s.logger().Info("listener removed", "addr", addr)
+	return err
+}
+
+// Listeners returns the status of all current listeners.
+//
+// Safe to call while ListenAndServe is running.
+func (s *Server) Listeners() []ListenerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ls := make([]ListenerStatus, len(s.listeners))
+	for i, l := range s.listeners {
+		ls[i].Addr = l.Addr
+		if st, ok := s.states[l]; ok {
+			ls[i].State = st.state
+			ls[i].Bound = st.bound
+			ls[i].Err = st.err
+			ls[i].Added = st.added
+		}
+	}
+	return ls
+}
+
+// listenAndServe is like l.ListenAndServe, with the state of l updated.
+// bound is set when the address of l was bound.
+// http.ErrServerClosed is returned without binding when the server was closed
+// or l was removed in the meantime.
+func (s *Server) listenAndServe(l *http.Server) (bound bool, err error) {
+	ln, err := s.bind(l)
+	if err != nil {
+		return false, err
+	}
+	s.logger().Info("listener serving", "addr", l.Addr, "bound", ln.Addr().String())
+	return true, l.Serve(ln)
+}
+
+// bind the address of l, unless the server was closed or l removed.
+// s.mu is held while binding, so that Close, RemoveListener and rebind
+// never return while a listener they stopped is still to bind its address.
+func (s *Server) bind(l *http.Server) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.states[l]
+	if s.closed || !ok {
+		return nil, http.ErrServerClosed
+	}
+	st.state, st.bound, st.err = Starting, nil, nil
+	ln, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return nil, err
+	}
+	st.state, st.bound = Serving, ln.Addr()
+	return ln, nil
+}
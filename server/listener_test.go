@@ -0,0 +1,129 @@
+// +build unit
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func waitState(t *testing.T, s *Server, addr string, want ListenerState) ListenerStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, ls := range s.Listeners() {
+			if ls.Addr == addr && ls.State == want {
+				return ls
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Listeners() = %v, want %s in state %v", s.Listeners(), addr, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_AddListener(t *testing.T) {
+	s := new(Server)
+	if err := s.AddListener("127.0.0.1:9000"); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Listeners(); len(got) != 1 || got[0].State != Idle || !got[0].Added {
+		t.Errorf("Listeners() = %v, want single added Idle listener", got)
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- s.ListenAndServe()
+	}()
+	waitState(t, s, "127.0.0.1:9000", Serving)
+
+	// Added while running
+	if err := s.AddListener("[::1]:0"); err != nil {
+		t.Fatal(err)
+	}
+	ls := waitState(t, s, "[::1]:0", Serving)
+	tca, ok := ls.Bound.(*net.TCPAddr)
+	if !ok || tca.Port == 0 {
+		t.Fatalf("Bound = %v, want a port", ls.Bound)
+	}
+	r, err := http.Get(fmt.Sprintf("http://%s/", tca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	if err := s.AddListener("127.0.0.1:9000"); !errors.Is(err, ErrListenerExists) {
+		t.Errorf("AddListener() error = %v, want %v", err, ErrListenerExists)
+	}
+	if err := s.AddListener("foo"); err == nil {
+		t.Error("AddListener() expected error")
+	}
+
+	// Removing all listeners keeps the server running
+	for _, a := range []string{"127.0.0.1:9000", "[::1]:0"} {
+		if err := s.RemoveListener(context.Background(), a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := s.Listeners(); len(got) != 0 {
+		t.Errorf("Listeners() = %v, want none", got)
+	}
+	if _, err := http.Get(fmt.Sprintf("http://%s/", tca)); err == nil {
+		t.Error("Removed listener still serving")
+	}
+	if err := s.RemoveListener(context.Background(), "127.0.0.1:9000"); !errors.Is(err, ErrListenerNotFound) {
+		t.Errorf("RemoveListener() error = %v, want %v", err, ErrListenerNotFound)
+	}
+	select {
+	case err := <-ec:
+		t.Fatalf("ListenAndServe() returned %v", err)
+	default:
+	}
+
+	s.Close()
+	select {
+	case <-ec:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() did not return after Close")
+	}
+	if err := s.AddListener("127.0.0.1:9000"); err != http.ErrServerClosed {
+		t.Errorf("AddListener() error = %v, want %v", err, http.ErrServerClosed)
+	}
+}
+
+func TestServer_Listeners_retrying(t *testing.T) {
+	s := &Server{
+		Retry: &Retry{Delay: time.Hour},
+		listeners: []*http.Server{
+			{Addr: "123.123.123.123:9000"},
+		},
+	}
+	go s.ListenAndServe()
+	defer s.Close()
+	ls := waitState(t, s, "123.123.123.123:9000", Retrying)
+	if ls.Err == nil || ls.Added {
+		t.Errorf("Listeners() = %v, want configured listener with error", ls)
+	}
+}
+
+func TestListenerState_String(t *testing.T) {
+	tests := []struct {
+		s    ListenerState
+		want string
+	}{
+		{Idle, "idle"},
+		{Serving, "serving"},
+		{Retrying, "retrying"},
+		{99, "ListenerState(99)"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("ListenerState.String() = %v, want %v", got, tt.want)
+		}
+	}
+}
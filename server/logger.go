@@ -0,0 +1,37 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Logger receives structured log events: a message with alternating key and value arguments.
+// It is implemented by *slog.Logger.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// logger returns the configured Logger, or slog.Default
+func (s *Server) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// callerArgs returns the log arguments identifying the caller and remote address of a RPC
+func callerArgs(caller *wgtypes.Peer, remote *net.TCPAddr) []interface{} {
+	var args []interface{}
+	if caller != nil {
+		args = append(args, "caller", caller.PublicKey.String())
+	}
+	if remote != nil {
+		args = append(args, "remote", remote.String())
+	}
+	return args
+}
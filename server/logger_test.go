@@ -0,0 +1,150 @@
+// +build unit
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// syncBuffer is a bytes.Buffer safe for concurrent writes
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+// events returns the decoded JSON log lines
+func (b *syncBuffer) events(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.b.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		e := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// find returns the first event with msg, or nil
+func find(events []map[string]interface{}, msg string) map[string]interface{} {
+	for _, e := range events {
+		if e["msg"] == msg {
+			return e
+		}
+	}
+	return nil
+}
+
+func TestServer_Logger(t *testing.T) {
+	keys := genKeys(t, 2)
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest", wgtypes.Peer{
+		PublicKey:  keys[0],
+		AllowedIPs: []net.IPNet{{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(32, 32)}},
+	})
+	buf := new(syncBuffer)
+	srv := &Server{
+		Backend: m,
+		ACL:     new(ACL),
+		Logger:  slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+	}
+	srv.ifaceIPs = loopbackIPs
+	h, err := newHandler("wgtest", srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	c, err := rpc.DialHTTP("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Call("RPC.Find", keys[1:], new(PeerMap)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Denied, the IPv6 loopback is not an allowed IP of the peer
+	ts6 := httptest.NewUnstartedServer(h)
+	ts6.Listener.Close()
+	if ts6.Listener, err = net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Fatal(err)
+	}
+	ts6.Start()
+	defer ts6.Close()
+	r, err := http.Get(ts6.URL + FindPeersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	events := buf.events(t)
+	tests := []struct {
+		msg  string
+		want map[string]interface{}
+	}{
+		{"rpc", map[string]interface{}{"level": "INFO", "method": "Find", "device": "wgtest", "caller": keys[0].String()}},
+		{"lookup", map[string]interface{}{"level": "DEBUG", "key": keys[1].String(), "status": NotFound.String()}},
+		{"access denied", map[string]interface{}{"level": "WARN", "device": "wgtest"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			e := find(events, tt.msg)
+			if e == nil {
+				t.Fatalf("event %q not in %v", tt.msg, events)
+			}
+			for k, v := range tt.want {
+				if e[k] != v {
+					t.Errorf("event %q %s = %v, want %v", tt.msg, k, e[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestServer_Logger_listeners(t *testing.T) {
+	buf := new(syncBuffer)
+	srv := &Server{
+		Logger: slog.New(slog.NewJSONHandler(buf, nil)),
+	}
+	if err := srv.AddListener("127.0.0.1:9000"); err != nil {
+		t.Fatal(err)
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- srv.ListenAndServe()
+	}()
+	waitState(t, srv, "127.0.0.1:9000", Serving)
+	srv.Close()
+	<-ec
+
+	events := buf.events(t)
+	for _, msg := range []string{"listener added", "listener serving", "listener closed"} {
+		if e := find(events, msg); e == nil || e["addr"] != "127.0.0.1:9000" {
+			t.Errorf("event %q = %v, want addr 127.0.0.1:9000", msg, e)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MemoryBackend is an in-memory Backend with fake WireGuard devices.
+// It allows to use and test the server without privileges or a WireGuard module.
+// It is safe for concurrent use.
+type MemoryBackend struct {
+	mu      sync.RWMutex
+	devices map[string]*wgtypes.Device
+}
+
+// NewMemoryBackend returns a MemoryBackend without devices
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		devices: make(map[string]*wgtypes.Device),
+	}
+}
+
+// SetPeers creates device name if it does not exist and replaces its peers
+func (m *MemoryBackend) SetPeers(name string, peers ...wgtypes.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dev := m.device(name)
+	dev.Peers = make([]wgtypes.Peer, len(peers))
+	for i, p := range peers {
+		dev.Peers[i] = copyPeer(p)
+	}
+}
+
+// RemoveDevice name, if it exists
+func (m *MemoryBackend) RemoveDevice(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.devices, name)
+}
+
+// Device returns a copy of the device identified by name.
+// Like wgctrl, an error satisfying os.IsNotExist is returned when the device does not exist.
+func (m *MemoryBackend) Device(name string) (*wgtypes.Device, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	dev, ok := m.devices[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	cp := *dev
+	cp.Peers = make([]wgtypes.Peer, len(dev.Peers))
+	for i, p := range dev.Peers {
+		cp.Peers[i] = copyPeer(p)
+	}
+	return &cp, nil
+}
+
+// Devices returns a copy of all devices, sorted by name
+func (m *MemoryBackend) Devices() ([]*wgtypes.Device, error) {
+	m.mu.RLock()
+	names := make([]string, 0, len(m.devices))
+	for name := range m.devices {
+		names = append(names, name)
+	}
+	m.mu.RUnlock()
+	sort.Strings(names)
+	devs := make([]*wgtypes.Device, 0, len(names))
+	for _, name := range names {
+		// Removed in the meantime
+		if dev, err := m.Device(name); err == nil {
+			devs = append(devs, dev)
+		}
+	}
+	return devs, nil
+}
+
+// ConfigureDevice applies cfg to device name, like wgctrl does for a real device.
+// The device is created if it does not exist.
+func (m *MemoryBackend) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dev := m.device(name)
+	if cfg.PrivateKey != nil {
+		dev.PrivateKey, dev.PublicKey = *cfg.PrivateKey, wgtypes.Key{}
+		if dev.PrivateKey != (wgtypes.Key{}) {
+			dev.PublicKey = dev.PrivateKey.PublicKey()
+		}
+	}
+	if cfg.ListenPort != nil {
+		dev.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		dev.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		dev.Peers = nil
+	}
+	for _, pc := range cfg.Peers {
+		i := -1
+		for j, p := range dev.Peers {
+			if p.PublicKey == pc.PublicKey {
+				i = j
+				break
+			}
+		}
+		if pc.Remove {
+			if i >= 0 {
+				dev.Peers = append(dev.Peers[:i], dev.Peers[i+1:]...)
+			}
+			continue
+		}
+		if i < 0 {
+			dev.Peers = append(dev.Peers, wgtypes.Peer{PublicKey: pc.PublicKey, ProtocolVersion: 1})
+			i = len(dev.Peers) - 1
+		}
+		applyPeerConfig(&dev.Peers[i], pc)
+	}
+	return nil
+}
+
+// device returns the device identified by name, it is created if it does not exist.
+// m.mu must be locked by the caller.
+func (m *MemoryBackend) device(name string) *wgtypes.Device {
+	dev, ok := m.devices[name]
+	if !ok {
+		dev = &wgtypes.Device{
+			Name: name,
+			Type: wgtypes.Unknown,
+		}
+		m.devices[name] = dev
+	}
+	return dev
+}
+
+// applyPeerConfig to p
+func applyPeerConfig(p *wgtypes.Peer, pc wgtypes.PeerConfig) {
+	if pc.PresharedKey != nil {
+		p.PresharedKey = *pc.PresharedKey
+	}
+	if pc.Endpoint != nil {
+		ep := *pc.Endpoint
+		p.Endpoint = &ep
+	}
+	if pc.PersistentKeepaliveInterval != nil {
+		p.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+	}
+	if pc.ReplaceAllowedIPs {
+		p.AllowedIPs = nil
+	}
+	p.AllowedIPs = append(append([]net.IPNet(nil), p.AllowedIPs...), pc.AllowedIPs...)
+}
+
+// copyPeer returns a copy of p, not sharing the Endpoint and AllowedIPs
+func copyPeer(p wgtypes.Peer) wgtypes.Peer {
+	if p.Endpoint != nil {
+		ep := *p.Endpoint
+		p.Endpoint = &ep
+	}
+	p.AllowedIPs = append([]net.IPNet(nil), p.AllowedIPs...)
+	return p
+}
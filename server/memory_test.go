@@ -0,0 +1,114 @@
+// +build unit
+
+package server
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestMemoryBackend_Device(t *testing.T) {
+	keys := genKeys(t, 1)
+	m := NewMemoryBackend()
+	if _, err := m.Device("foo"); !os.IsNotExist(err) {
+		t.Fatalf("MemoryBackend.Device() error = %v, want not exist", err)
+	}
+	ep := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 123}
+	m.SetPeers("wgtest", wgtypes.Peer{PublicKey: keys[0], Endpoint: ep})
+
+	got, err := m.Device("wgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &wgtypes.Device{
+		Name:  "wgtest",
+		Peers: []wgtypes.Peer{{PublicKey: keys[0], Endpoint: ep}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MemoryBackend.Device() = %v, want %v", got, want)
+	}
+	// Modifying the copy does not affect the backend
+	got.Peers[0].Endpoint.Port = 456
+	if got, _ = m.Device("wgtest"); got.Peers[0].Endpoint.Port != 123 {
+		t.Errorf("MemoryBackend.Device() shares endpoint with caller")
+	}
+
+	m.RemoveDevice("wgtest")
+	if _, err := m.Device("wgtest"); !os.IsNotExist(err) {
+		t.Errorf("MemoryBackend.Device() error = %v, want not exist", err)
+	}
+}
+
+func TestMemoryBackend_Devices(t *testing.T) {
+	m := NewMemoryBackend()
+	m.SetPeers("wgb")
+	m.SetPeers("wga")
+	devs, err := m.Devices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range devs {
+		got = append(got, d.Name)
+	}
+	if want := []string{"wga", "wgb"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MemoryBackend.Devices() = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryBackend_ConfigureDevice(t *testing.T) {
+	keys := genKeys(t, 3)
+	priv, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := 51820
+	ep := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 123}
+	_, ipn, _ := net.ParseCIDR("10.0.0.1/32")
+
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: keys[0]},
+		wgtypes.Peer{PublicKey: keys[1]},
+	)
+	err = m.ConfigureDevice("wgtest", wgtypes.Config{
+		PrivateKey: &priv,
+		ListenPort: &port,
+		Peers: []wgtypes.PeerConfig{
+			{PublicKey: keys[0], Endpoint: ep},
+			{PublicKey: keys[1], Remove: true},
+			{PublicKey: keys[2], AllowedIPs: []net.IPNet{*ipn}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.Device("wgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &wgtypes.Device{
+		Name:       "wgtest",
+		PrivateKey: priv,
+		PublicKey:  priv.PublicKey(),
+		ListenPort: port,
+		Peers: []wgtypes.Peer{
+			{PublicKey: keys[0], Endpoint: ep},
+			{PublicKey: keys[2], ProtocolVersion: 1, AllowedIPs: []net.IPNet{*ipn}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MemoryBackend.ConfigureDevice() = \n%v\n, want \n%v\n", got, want)
+	}
+
+	if err = m.ConfigureDevice("wgtest", wgtypes.Config{ReplacePeers: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ = m.Device("wgtest"); len(got.Peers) != 0 {
+		t.Errorf("MemoryBackend.ConfigureDevice() peers = %v, want none", got.Peers)
+	}
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MetricsPath serves the metrics of the Server in the Prometheus text exposition format.
+const MetricsPath = "/metrics"
+
+// DefaultStaleThreshold is the handshake age after which a peer is reported as stale.
+const DefaultStaleThreshold = 3 * time.Minute
+
+// latencyBuckets are the upper bounds of the request duration histogram, in seconds
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// histogram of observed durations, with cumulative counts written per bucket
+type histogram struct {
+	counts []uint64 // non-cumulative, per latencyBuckets and +Inf
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+type requestKey struct {
+	method string
+	result string
+}
+
+// metrics collected by the RPC methods of a Server.
+// The zero value is ready to use, a nil *metrics discards all observations.
+type metrics struct {
+	mu            sync.Mutex
+	requests      map[requestKey]uint64
+	latency       map[string]*histogram
+	lookups       map[Status]uint64
+	backendErrors uint64
+}
+
+// observe a RPC method call which started at start and returned *err
+func (m *metrics) observe(method string, start time.Time, err *error) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start).Seconds()
+	result := "ok"
+	if *err != nil {
+		result = "error"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.requests == nil {
+		m.requests = make(map[requestKey]uint64)
+		m.latency = make(map[string]*histogram)
+	}
+	m.requests[requestKey{method, result}]++
+	h, ok := m.latency[method]
+	if !ok {
+		h = new(histogram)
+		m.latency[method] = h
+	}
+	h.observe(d)
+}
+
+// lookup counts the Status of a peer returned by Find
+func (m *metrics) lookup(s Status) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.lookups == nil {
+		m.lookups = make(map[Status]uint64)
+	}
+	m.lookups[s]++
+}
+
+func (m *metrics) backendError() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.backendErrors++
+	m.mu.Unlock()
+}
+
+// countingBackend counts the errors of a Backend
+type countingBackend struct {
+	Backend
+	m *metrics
+}
+
+func (b countingBackend) Device(name string) (*wgtypes.Device, error) {
+	d, err := b.Backend.Device(name)
+	if err != nil {
+		b.m.backendError()
+	}
+	return d, err
+}
+
+// metricsWriter writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	*bufio.Writer
+}
+
+func (w metricsWriter) header(name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes name{labels} v, labels are name and value pairs
+func (w metricsWriter) sample(name string, v interface{}, labels ...string) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %v\n", v)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeTo writes the collected metrics
+func (m *metrics) writeTo(w metricsWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].result < keys[j].result
+	})
+	w.header("wire_directory_requests_total", "counter", "RPC method calls by result.")
+	for _, k := range keys {
+		w.sample("wire_directory_requests_total", m.requests[k], "method", k.method, "result", k.result)
+	}
+
+	methods := make([]string, 0, len(m.latency))
+	for k := range m.latency {
+		methods = append(methods, k)
+	}
+	sort.Strings(methods)
+	w.header("wire_directory_request_duration_seconds", "histogram", "RPC method call duration.")
+	for _, method := range methods {
+		h := m.latency[method]
+		var c uint64
+		for i, b := range latencyBuckets {
+			c += h.counts[i]
+			w.sample("wire_directory_request_duration_seconds_bucket", c, "method", method, "le", fmt.Sprint(b))
+		}
+		w.sample("wire_directory_request_duration_seconds_bucket", h.count, "method", method, "le", "+Inf")
+		w.sample("wire_directory_request_duration_seconds_sum", h.sum, "method", method)
+		w.sample("wire_directory_request_duration_seconds_count", h.count, "method", method)
+	}
+
+	w.header("wire_directory_lookups_total", "counter", "Peers returned by Find, by status.")
+	for _, s := range []Status{Found, NoEndpoint, NotFound, NotVisible} {
+		t, _ := s.MarshalText()
+		w.sample("wire_directory_lookups_total", m.lookups[s], "status", string(t))
+	}
+
+	w.header("wire_directory_backend_errors_total", "counter", "Failed WireGuard device queries.")
+	w.sample("wire_directory_backend_errors_total", m.backendErrors)
+}
+
+// MetricsHandler returns a handler serving the metrics of s
+// in the Prometheus text exposition format.
+// The device gauges are written for all devices of s.
+// It is served on MetricsPath of the listeners as well, with the gauges of the listener's device.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.serveMetrics(w, r, s.Devices(), nil)
+	})
+}
+
+// serveMetrics writes the metrics of s, with the gauges of devices queried from b.
+// The Backend of s, or a new wgctrl client is used when b is nil.
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request, devices []string, b Backend) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := metricsWriter{bufio.NewWriter(w)}
+	s.metrics.writeTo(mw)
+	s.writeDeviceMetrics(mw, devices, b)
+	s.writeListenerMetrics(mw)
+	if err := mw.Flush(); err != nil {
+		s.logger().Warn("metrics write failed", "remote", r.RemoteAddr, "error", err)
+	}
+}
+
+// staleThreshold returns the configured or default StaleThreshold
+func (s *Server) staleThreshold() time.Duration {
+	if s.StaleThreshold > 0 {
+		return s.StaleThreshold
+	}
+	return DefaultStaleThreshold
+}
+
+func (s *Server) writeDeviceMetrics(w metricsWriter, devices []string, b Backend) {
+	type gauges struct {
+		up, peers, stale int
+	}
+	gs := make([]gauges, len(devices))
+	now := time.Now()
+	for i, device := range devices {
+		dev, err := s.readDevice(device, b)
+		if err != nil {
+			s.metrics.backendError()
+			continue
+		}
+		gs[i].up = 1
+		gs[i].peers = len(dev.Peers)
+		for _, p := range dev.Peers {
+			if now.Sub(p.LastHandshakeTime) > s.staleThreshold() {
+				gs[i].stale++
+			}
+		}
+	}
+	w.header("wire_directory_device_up", "gauge", "Whether the WireGuard device could be queried.")
+	for i, device := range devices {
+		w.sample("wire_directory_device_up", gs[i].up, "device", device)
+	}
+	w.header("wire_directory_peers", "gauge", "Peers on the WireGuard device.")
+	for i, device := range devices {
+		w.sample("wire_directory_peers", gs[i].peers, "device", device)
+	}
+	w.header("wire_directory_stale_peers", "gauge", "Peers without a handshake during the stale threshold.")
+	for i, device := range devices {
+		w.sample("wire_directory_stale_peers", gs[i].stale, "device", device)
+	}
+}
+
+func (s *Server) writeListenerMetrics(w metricsWriter) {
+	w.header("wire_directory_listener_up", "gauge", "Whether the listener is serving.")
+	for _, l := range s.Listeners() {
+		up := 0
+		if l.State == Serving {
+			up = 1
+		}
+		w.sample("wire_directory_listener_up", up, "addr", l.Addr)
+	}
+}
@@ -0,0 +1,121 @@
+// +build unit
+
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestMetrics(t *testing.T) {
+	keys := genKeys(t, 3)
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{
+			PublicKey:         keys[0],
+			Endpoint:          &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 123},
+			LastHandshakeTime: time.Now(),
+		},
+		wgtypes.Peer{
+			PublicKey: keys[1],
+		},
+	)
+	srv := &Server{
+		Backend: m,
+		listeners: []*http.Server{
+			{Addr: "127.0.0.1:9000"},
+		},
+	}
+	h, err := newHandler("wgtest", srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	c, err := rpc.DialHTTP("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var pm PeerMap
+	if err = c.Call("RPC.Find", keys, &pm); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Call("RPC.Announce", Announcement{}, new(AnnounceReply)); err == nil {
+		t.Fatal("RPC.Announce() expected error without caller")
+	}
+
+	r, err := http.Get(ts.URL + MetricsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(body)
+	for _, want := range []string{
+		`wire_directory_requests_total{method="Find",result="ok"} 1`,
+		`wire_directory_requests_total{method="Announce",result="error"} 1`,
+		`wire_directory_request_duration_seconds_bucket{method="Find",le="+Inf"} 1`,
+		`wire_directory_request_duration_seconds_count{method="Find"} 1`,
+		`wire_directory_lookups_total{status="found"} 1`,
+		`wire_directory_lookups_total{status="no_endpoint"} 1`,
+		`wire_directory_lookups_total{status="not_found"} 1`,
+		`wire_directory_backend_errors_total 0`,
+		`wire_directory_device_up{device="wgtest"} 1`,
+		`wire_directory_peers{device="wgtest"} 2`,
+		`wire_directory_stale_peers{device="wgtest"} 1`,
+		`wire_directory_listener_up{addr="127.0.0.1:9000"} 0`,
+		`# TYPE wire_directory_request_duration_seconds histogram`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("metrics missing %q in\n%s", want, got)
+		}
+	}
+}
+
+func TestMetrics_backendError(t *testing.T) {
+	srv := &Server{Backend: NewMemoryBackend()}
+	w := httptest.NewRecorder()
+	srv.serveMetrics(w, httptest.NewRequest(http.MethodGet, MetricsPath, nil), []string{"wgtest"}, nil)
+	if got := w.Body.String(); !strings.Contains(got, `wire_directory_device_up{device="wgtest"} 0`+"\n") {
+		t.Errorf("metrics = %s, want device down", got)
+	}
+	w = httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, MetricsPath, nil))
+	// The error of the first scrape
+	if got := w.Body.String(); !strings.Contains(got, "wire_directory_backend_errors_total 1\n") {
+		t.Errorf("metrics = %s, want 1 backend error", got)
+	}
+}
+
+func Test_metrics_observe(t *testing.T) {
+	var m *metrics
+	err := errors.New("foo")
+	m.observe("Find", time.Now(), &err)
+	m.lookup(Found)
+	m.backendError()
+
+	m = new(metrics)
+	m.observe("Find", time.Now().Add(-30*time.Millisecond), &err)
+	h := m.latency["Find"]
+	// 0.05 bucket
+	if h.count != 1 || h.counts[3] != 1 {
+		t.Errorf("histogram = %v, want a single observation in the 0.05 bucket", h.counts)
+	}
+	if m.requests[requestKey{"Find", "error"}] != 1 {
+		t.Errorf("requests = %v", m.requests)
+	}
+}
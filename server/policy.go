@@ -0,0 +1,118 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// AnyPeer matches all peers in the From and To of a Rule
+const AnyPeer = "*"
+
+// Rule of a Policy, matching lookups by callers in From of peers in To.
+// From and To contain group names or AnyPeer.
+type Rule struct {
+	From []string
+	To   []string
+	// Deny the matched lookups, they are allowed otherwise
+	Deny bool
+}
+
+// Policy decides which peers a caller may find, by the groups of the caller and the peer.
+// The first Rule matching a lookup decides, lookups matching no rule are denied.
+// A peer can always find itself.
+//
+// Callers are identified by access control or authentication;
+// callers without identity can not find any peer.
+// Peers which are not visible to the caller are reported with Status NotVisible,
+// whether they are known or not.
+//
+// A Policy is immutable, it is safe for concurrent use.
+type Policy struct {
+	rules []Rule
+	// groups of each member
+	groups map[wgtypes.Key]map[string]bool
+}
+
+// NewPolicy returns a Policy with the groups of peers, by name, and the rules.
+// Rules may only refer to the given groups or AnyPeer.
+func NewPolicy(groups map[string][]wgtypes.Key, rules []Rule) (*Policy, error) {
+	p := &Policy{
+		rules:  append([]Rule(nil), rules...),
+		groups: make(map[wgtypes.Key]map[string]bool),
+	}
+	for name, keys := range groups {
+		if name == AnyPeer {
+			return nil, fmt.Errorf("group name %q is reserved", AnyPeer)
+		}
+		for _, k := range keys {
+			if p.groups[k] == nil {
+				p.groups[k] = make(map[string]bool)
+			}
+			p.groups[k][name] = true
+		}
+	}
+	for i, r := range rules {
+		if len(r.From) == 0 || len(r.To) == 0 {
+			return nil, fmt.Errorf("rule %d: from and to required", i)
+		}
+		for _, g := range append(r.From[:len(r.From):len(r.From)], r.To...) {
+			if _, ok := groups[g]; !ok && g != AnyPeer {
+				return nil, fmt.Errorf("rule %d: unknown group %q", i, g)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Groups returns the sorted groups of the peer with key
+func (p *Policy) Groups(key wgtypes.Key) []string {
+	var gs []string
+	for g := range p.groups[key] {
+		gs = append(gs, g)
+	}
+	sort.Strings(gs)
+	return gs
+}
+
+// member reports whether key is in one of the groups
+func (p *Policy) member(key wgtypes.Key, groups []string) bool {
+	for _, g := range groups {
+		if g == AnyPeer || p.groups[key][g] {
+			return true
+		}
+	}
+	return false
+}
+
+// Visible reports whether the peer with key from may find the peer with key to.
+func (p *Policy) Visible(from, to wgtypes.Key) bool {
+	if from == to {
+		return true
+	}
+	for _, r := range p.rules {
+		if p.member(from, r.From) && p.member(to, r.To) {
+			return !r.Deny
+		}
+	}
+	return false
+}
+
+// visible reports whether caller may find the peer with key.
+// All peers are visible without policy, none to a caller without identity.
+func (p *Policy) visible(caller *wgtypes.Peer, key wgtypes.Key) bool {
+	if p == nil {
+		return true
+	}
+	return caller != nil && p.Visible(caller.PublicKey, key)
+}
+
+// SetPolicy replaces the visibility Policy of the Server,
+// which applies to Find and the records returned by Gossip.
+// All peers are visible when p is nil, which is the default.
+//
+// Safe to call while ListenAndServe is running, to reload a policy.
+func (s *Server) SetPolicy(p *Policy) {
+	s.policy.Store(p)
+}
@@ -0,0 +1,147 @@
+// +build unit
+
+package server
+
+import (
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestNewPolicy(t *testing.T) {
+	keys := genKeys(t, 1)
+	tests := []struct {
+		name    string
+		groups  map[string][]wgtypes.Key
+		rules   []Rule
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"any peer", nil, []Rule{{From: []string{AnyPeer}, To: []string{AnyPeer}}}, false},
+		{"groups", map[string][]wgtypes.Key{"a": keys}, []Rule{{From: []string{"a"}, To: []string{AnyPeer}}}, false},
+		{"reserved name", map[string][]wgtypes.Key{AnyPeer: keys}, nil, true},
+		{"no from", nil, []Rule{{To: []string{AnyPeer}}}, true},
+		{"no to", nil, []Rule{{From: []string{AnyPeer}}}, true},
+		{"unknown group", nil, []Rule{{From: []string{AnyPeer}, To: []string{"a"}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewPolicy(tt.groups, tt.rules); (err != nil) != tt.wantErr {
+				t.Errorf("NewPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicy_Visible(t *testing.T) {
+	keys := genKeys(t, 5)
+	laptops, servers, other := keys[0:2], keys[2:4], keys[4]
+	p, err := NewPolicy(map[string][]wgtypes.Key{
+		"laptops": laptops,
+		"servers": servers,
+	}, []Rule{
+		{From: []string{"laptops"}, To: []string{"servers"}},
+		{From: []string{"servers"}, To: []string{"servers"}, Deny: true},
+		{From: []string{"servers"}, To: []string{AnyPeer}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		from, to wgtypes.Key
+		want     bool
+	}{
+		{"laptop to server", laptops[0], servers[0], true},
+		{"laptop to laptop", laptops[0], laptops[1], false},
+		{"laptop to itself", laptops[0], laptops[0], true},
+		{"server to server", servers[0], servers[1], false},
+		{"server to laptop", servers[0], laptops[0], true},
+		{"server to other", servers[0], other, true},
+		{"other to server", other, servers[0], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.Visible(tt.from, tt.to); got != tt.want {
+				t.Errorf("Visible() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := p.Groups(laptops[0]); !reflect.DeepEqual(got, []string{"laptops"}) {
+		t.Errorf("Groups() = %v, want [laptops]", got)
+	}
+}
+
+func TestRPC_Find_policy(t *testing.T) {
+	keys := genKeys(t, 4)
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: keys[0]},
+		wgtypes.Peer{PublicKey: keys[1], Endpoint: a, LastHandshakeTime: now},
+		wgtypes.Peer{PublicKey: keys[2], Endpoint: a, LastHandshakeTime: now},
+	)
+	p, err := NewPolicy(map[string][]wgtypes.Key{
+		"laptops": {keys[0], keys[2]},
+		"servers": {keys[1]},
+	}, []Rule{
+		{From: []string{"laptops"}, To: []string{"servers"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &RPC{
+		device:  "wgtest",
+		wgc:     m,
+		caller:  &wgtypes.Peer{PublicKey: keys[0]},
+		records: new(records),
+		policy:  new(atomic.Pointer[Policy]),
+	}
+
+	// All peers are visible without policy
+	pm := new(PeerMap)
+	if err = s.Find(keys, pm); err != nil {
+		t.Fatal(err)
+	}
+	if got := pm.Peers[keys[2]].Status; got != Found {
+		t.Errorf("RPC.Find() status = %v, want %v", got, Found)
+	}
+
+	s.policy.Store(p)
+	if err = s.Find(keys, pm); err != nil {
+		t.Fatal(err)
+	}
+	want := map[wgtypes.Key]Status{
+		keys[0]: NoEndpoint,
+		keys[1]: Found,
+		keys[2]: NotVisible,
+		keys[3]: NotVisible,
+	}
+	for k, st := range want {
+		if got := pm.Peers[k]; got.Status != st || got.Endpoint != nil && st == NotVisible {
+			t.Errorf("RPC.Find() %s = %v, want status %v", k, got, st)
+		}
+	}
+
+	var rs []Record
+	if err = s.Gossip(nil, &rs); err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].PublicKey != keys[1] {
+		t.Errorf("RPC.Gossip() = %v, want the record of %s", rs, keys[1])
+	}
+
+	// Callers without identity can not find any peer
+	s.caller = nil
+	if err = s.Find(keys[1:2], pm); err != nil {
+		t.Fatal(err)
+	}
+	if got := pm.Peers[keys[1]].Status; got != NotVisible {
+		t.Errorf("RPC.Find() status = %v, want %v", got, NotVisible)
+	}
+}
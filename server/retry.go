@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// Defaults for Retry
+const (
+	DefaultRetryDelay    = time.Second
+	DefaultRetryMaxDelay = time.Minute
+)
+
+// Retry policy for failed listeners, see Server.Retry.
+type Retry struct {
+	// Delay before the first retry, doubled after every failure up to MaxDelay.
+	// DefaultRetryDelay and DefaultRetryMaxDelay are used when zero.
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// Attempts is the number of retries after which a listener is permanently dead.
+	// Retries are unlimited when zero.
+	Attempts int
+}
+
+// delay before retry n, starting at 1
+func (r *Retry) delay(n int) time.Duration {
+	d, max := r.Delay, r.MaxDelay
+	if d <= 0 {
+		d = DefaultRetryDelay
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxDelay
+	}
+	for i := 1; i < n && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		return max
+	}
+	return d
+}
+
+// serve on l until it is closed, the result reports if l was bound.
+// Failures are retried according to s.Retry, until quit is closed.
+func (s *Server) serve(l *http.Server, quit <-chan struct{}) served {
+	r := served{l: l}
+	for n := 1; ; n++ {
+		bound, err := s.listenAndServe(l)
+		r.bound, r.err = r.bound || bound, err
+		if err == http.ErrServerClosed || s.Retry == nil {
+			return r
+		}
+		if s.Retry.Attempts > 0 && n > s.Retry.Attempts {
+			s.logger().Error("listener dead", "addr", l.Addr, "error", err, "retries", s.Retry.Attempts)
+			return r
+		}
+		d := s.Retry.delay(n)
+		s.logger().Warn("listener failed, retrying", "addr", l.Addr, "error", err, "delay", d)
+		s.setState(l, Retrying, nil, err)
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-quit:
+			t.Stop()
+			r.err = http.ErrServerClosed
+			return r
+		}
+	}
+}
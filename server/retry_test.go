@@ -0,0 +1,148 @@
+// +build unit
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetry_delay(t *testing.T) {
+	tests := []struct {
+		name  string
+		retry Retry
+		n     int
+		want  time.Duration
+	}{
+		{"Defaults", Retry{}, 1, DefaultRetryDelay},
+		{"Defaults max", Retry{}, 100, DefaultRetryMaxDelay},
+		{"First", Retry{Delay: time.Second, MaxDelay: time.Minute}, 1, time.Second},
+		{"Doubled", Retry{Delay: time.Second, MaxDelay: time.Minute}, 3, 4 * time.Second},
+		{"Capped", Retry{Delay: time.Second, MaxDelay: 5 * time.Second}, 4, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.retry.delay(tt.n); got != tt.want {
+				t.Errorf("Retry.delay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_ListenAndServe_retry(t *testing.T) {
+	s := &Server{
+		Retry: &Retry{
+			Delay:    time.Millisecond,
+			Attempts: 2,
+		},
+		listeners: []*http.Server{
+			{Addr: "127.0.0.1:9000"},
+			{Addr: "123.123.123.123:9000"},
+		},
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- s.ListenAndServe()
+	}()
+
+	// The failing listener is dead and removed, the other one keeps serving.
+	waitAddrs(t, s, 1)
+	r, err := http.Get("http://127.0.0.1:9000/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	select {
+	case err := <-ec:
+		t.Fatalf("ListenAndServe() returned %v", err)
+	default:
+	}
+
+	s.Close()
+	select {
+	case err := <-ec:
+		var le *ListenerError
+		if !errors.As(err, &le) || le.Addr != "123.123.123.123:9000" {
+			t.Errorf("ListenAndServe() error = %v, want error of the dead listener", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() did not return after Close")
+	}
+}
+
+func TestServer_ListenAndServe_dead(t *testing.T) {
+	s := &Server{
+		Retry: &Retry{
+			Delay:    time.Millisecond,
+			Attempts: 1,
+		},
+		listeners: []*http.Server{
+			{Addr: "123.123.123.123:9000"},
+			{Addr: "123.123.123.124:9000"},
+		},
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- s.ListenAndServe()
+	}()
+	select {
+	case err := <-ec:
+		if err == nil || err == http.ErrServerClosed {
+			t.Errorf("ListenAndServe() error = %v, want bind error", err)
+		}
+	case <-time.After(5 * time.Second):
+		s.Close()
+		t.Fatal("ListenAndServe() did not return with all listeners dead")
+	}
+}
+
+func TestServer_Close_retry(t *testing.T) {
+	s := &Server{
+		Retry: &Retry{
+			Delay: time.Hour,
+		},
+		listeners: []*http.Server{
+			{Addr: "123.123.123.123:9000"},
+		},
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- s.ListenAndServe()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	s.Close()
+	select {
+	case err := <-ec:
+		if err != http.ErrServerClosed {
+			t.Errorf("ListenAndServe() error = %v, want %v", err, http.ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() did not return during backoff")
+	}
+}
+
+func TestServer_Close_beforeListenAndServe(t *testing.T) {
+	s := &Server{
+		Retry: &Retry{
+			Delay: time.Hour,
+		},
+		listeners: []*http.Server{
+			{Addr: "123.123.123.123:9000"},
+		},
+	}
+	s.Close()
+	ec := make(chan error, 1)
+	go func() {
+		ec <- s.ListenAndServe()
+	}()
+	select {
+	case err := <-ec:
+		if err != http.ErrServerClosed {
+			t.Errorf("ListenAndServe() error = %v, want %v", err, http.ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() did not return on a closed server")
+	}
+}
@@ -1,16 +1,63 @@
 package server
 
 import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"net/rpc"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
+// Backend gives read access to WireGuard devices.
+// It is implemented by *wgctrl.Client and MemoryBackend.
+type Backend interface {
+	Device(name string) (*wgtypes.Device, error)
+}
+
 // RPC server implementation
 type RPC struct {
-	device string
-	wgc    *wgctrl.Client
+	device     string
+	wgc        Backend
+	disclosure *Disclosure
+	// mu protects caller, authKey and needAuth, which are set by Authenticate
+	mu sync.Mutex
+	// caller is the device peer which made the RPC connection.
+	// Only set when access control or authentication is enabled.
+	caller *wgtypes.Peer
+	// authKey is the key the caller authenticated with, see Authenticate
+	authKey *wgtypes.Key
+	// needAuth is set when the caller needs to authenticate before other calls
+	needAuth bool
+	acl      *ACL
+	// remote address of the RPC connection
+	remote      *net.TCPAddr
+	announced   *announcements
+	announceTTL time.Duration
+	// records is the gossip view, nil when gossip is disabled
+	records *records
+	// signingKey and trust of the Server, nil for the RPC of NewRPC
+	signingKey ed25519.PrivateKey
+	trust      TrustList
+	// policy of the Server, nil for the RPC of NewRPC
+	policy *atomic.Pointer[Policy]
+	// sessions of the Server, nil when authentication is disabled
+	sessions   *sessions
+	sessionTTL time.Duration
+	// metrics and log of the Server, nil for the RPC of NewRPC
+	metrics *metrics
+	log     Logger
+	// scope returns the RPC for another device of the Server, see FindDevice.
+	// nil for the RPC of NewRPC, which only serves its device.
+	scope func(device string) (*RPC, error)
 }
 
 // NewRPC initializes the RPC server with wg client
@@ -19,26 +66,367 @@ func NewRPC(device string) (*rpc.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	s := rpc.NewServer()
-	err = s.Register(
+	return NewRPCBackend(device, wgc)
+}
+
+// NewRPCBackend initializes the RPC server with a custom backend
+func NewRPCBackend(device string, b Backend) (*rpc.Server, error) {
+	return registerRPC(
 		&RPC{
-			wgc:    wgc,
+			wgc:    b,
 			device: device,
 		},
 	)
-	if err != nil {
+}
+
+// registerRPC returns a new rpc.Server with r registered
+func registerRPC(r *RPC) (*rpc.Server, error) {
+	s := rpc.NewServer()
+	if err := s.Register(r); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
+// handler serves each RPC connection or HTTP request with its own RPC object,
+// which carries the identity of the caller.
+// HTTP CONNECT requests are served by net/rpc with gob encoding,
+// the JSON APIs are served on JSONRPCPath, FindPeersPath and PeersPath,
+// metrics on MetricsPath. HealthzPath and ReadyzPath are served without access control.
+// With authentication, RPC connections are accepted from unknown callers,
+// which need to authenticate before other calls.
+type handler struct {
+	device string
+	wgc    *wgctrl.Client
+	srv    *Server
+}
+
+// backend returns the Backend of the server if set, or the wg client otherwise
+func (h *handler) backend() Backend {
+	if b := h.srv.Backend; b != nil {
+		return b
+	}
+	return h.wgc
+}
+
+// newHandler initializes a handler with wg client.
+// Settings, like Disclosure and ACL, are read from srv on each connection.
+func newHandler(device string, srv *Server) (*handler, error) {
+	wgc, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	return &handler{
+		device: device,
+		wgc:    wgc,
+		srv:    srv,
+	}, nil
+}
+
+// close the wgctrl client of h
+func (h *handler) close() error {
+	if h.wgc == nil {
+		return nil
+	}
+	return h.wgc.Close()
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case HealthzPath:
+		h.serveHealth(w, r, h.srv.Healthy)
+		return
+	case ReadyzPath:
+		h.serveHealth(w, r, func() error {
+			return h.srv.ready(h.device, h.backend())
+		})
+		return
+	}
+	caller, status, err := h.authorize(r)
+	needAuth := err != nil && h.challengeable(r, err)
+	if err != nil && !needAuth {
+		h.srv.logger().Warn("access denied", "remote", r.RemoteAddr, "device", h.device, "error", err)
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	rpcs := h.newRPC(h.device, r, caller)
+	rpcs.needAuth = needAuth
+	switch {
+	case r.Method == http.MethodConnect:
+		h.serveGob(w, r, rpcs)
+	case r.URL.Path == MetricsPath:
+		h.srv.serveMetrics(w, r, []string{h.device}, h.backend())
+	case r.URL.Path == JSONRPCPath:
+		serveJSONRPC(w, r, rpcs)
+	case r.URL.Path == FindPeersPath:
+		serveFindPeers(w, r, rpcs)
+	case strings.HasPrefix(r.URL.Path, PeersPath):
+		serveGetPeer(w, r, rpcs)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// newRPC returns a RPC object for device and the request r made by caller
+func (h *handler) newRPC(device string, r *http.Request, caller *wgtypes.Peer) *RPC {
+	st := h.srv.deviceStores(device)
+	rpcs := &RPC{
+		device:      device,
+		wgc:         countingBackend{h.backend(), &h.srv.metrics},
+		disclosure:  &h.srv.Disclosure,
+		caller:      caller,
+		acl:         h.srv.ACL,
+		signingKey:  h.srv.SigningKey,
+		trust:       h.srv.Trust,
+		policy:      &h.srv.policy,
+		remote:      remoteAddr(r),
+		announced:   &st.announced,
+		announceTTL: h.srv.announceTTL(),
+		metrics:     &h.srv.metrics,
+		log:         h.srv.logger(),
+	}
+	if h.srv.Gossip {
+		rpcs.records = &st.records
+	}
+	if auth := h.srv.Auth; auth != nil {
+		rpcs.sessions = &h.srv.sessions
+		rpcs.sessionTTL = auth.sessionTTL()
+	}
+	rpcs.scope = func(device string) (*RPC, error) {
+		if !h.srv.serves(device) {
+			return nil, fmt.Errorf("%s: %w", device, ErrUnknownDevice)
+		}
+		var (
+			caller *wgtypes.Peer
+			err    error
+		)
+		if key := rpcs.authenticated(); key != nil {
+			caller, _, err = h.authorizeKey(device, *key)
+		} else {
+			caller, _, err = h.authorizeDevice(device, r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return h.newRPC(device, r, caller), nil
+	}
+	return rpcs
+}
+
+// serveGob serves a net/rpc connection with gob encoding
+func (h *handler) serveGob(w http.ResponseWriter, r *http.Request, rpcs *RPC) {
+	rs, err := registerRPC(rpcs)
+	if err != nil {
+		h.srv.logger().Error("rpc register failed", "device", h.device, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	rs.ServeHTTP(w, r)
+}
+
+// done records a RPC method call which started at start and returned *err,
+// in the metrics and the log
+func (s *RPC) done(method string, start time.Time, err *error) {
+	s.metrics.observe(method, start, err)
+	if s.log == nil {
+		return
+	}
+	args := append([]interface{}{"method", method, "device", s.device},
+		callerArgs(s.peer(), s.remote)...)
+	args = append(args, "duration", time.Since(start))
+	if *err != nil {
+		s.log.Warn("rpc failed", append(args, "error", *err)...)
+		return
+	}
+	s.log.Info("rpc", args...)
+}
+
+// currentPolicy returns the Policy of the Server, or nil
+func (s *RPC) currentPolicy() *Policy {
+	if s.policy == nil {
+		return nil
+	}
+	return s.policy.Load()
+}
+
+// debug logs a debug event, if the RPC has a Logger
+func (s *RPC) debug(msg string, args ...interface{}) {
+	if s.log != nil {
+		s.log.Debug(msg, args...)
+	}
+}
+
+// remoteAddr returns the remote address of r, or nil if it can not be parsed
+func remoteAddr(r *http.Request) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	pn, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: pn}
+}
+
+// Disclosure controls which optional peer information is shared by the directory.
+// The preshared key and traffic statistics are never shared.
+type Disclosure struct {
+	// AllowedIPs of peers are shared when true
+	AllowedIPs bool
+	// Private peers opt out of endpoint disclosure.
+	// Find reports them without endpoint or candidates, with Status NoEndpoint when known,
+	// and their records are neither gossiped nor kept in the gossip view.
+	Private []wgtypes.Key
+}
+
+// private reports whether the endpoint of the peer with key may not be disclosed
+func (d *Disclosure) private(key wgtypes.Key) bool {
+	if d == nil {
+		return false
+	}
+	for _, k := range d.Private {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Records returns the records of rs which may be disclosed,
+// without those of Private peers. rs is not modified.
+func (d *Disclosure) Records(rs []Record) []Record {
+	if d == nil || len(d.Private) == 0 {
+		return rs
+	}
+	disclosed := make([]Record, 0, len(rs))
+	for _, r := range rs {
+		if !d.private(r.PublicKey) {
+			disclosed = append(disclosed, r)
+		}
+	}
+	return disclosed
+}
+
+// Status of a requested peer in a Find response
+type Status int
+
+// Peer Status values
+const (
+	// NotFound means the key is not a peer of the directory's device
+	NotFound Status = iota
+	// NoEndpoint means the peer is known, but the directory has no endpoint for it
+	NoEndpoint
+	// Found means the peer is known and has an endpoint or announced candidates
+	Found
+	// NotVisible means the Policy of the directory does not allow the caller to find the peer.
+	// It is reported for known and unknown peers alike.
+	NotVisible
+)
+
+func (s Status) String() string {
+	switch s {
+	case NotFound:
+		return "not found"
+	case NoEndpoint:
+		return "no endpoint"
+	case Found:
+		return "found"
+	case NotVisible:
+		return "not visible"
+	default:
+		return fmt.Sprintf("Status(%d)", int(s))
+	}
+}
+
+// Peer is the information a directory shares about a WireGuard peer
+type Peer struct {
+	Status    Status
+	PublicKey wgtypes.Key
+	Endpoint  *net.UDPAddr
+	// LastHandshakeTime is the time Endpoint was observed, by the device of
+	// this directory or the Observer
+	LastHandshakeTime time.Time
+	// AllowedIPs is only set when enabled by the server's Disclosure
+	AllowedIPs []net.IPNet
+	// Candidates are the endpoints announced by the peer itself
+	Candidates []*net.UDPAddr
+	// Announced is the time the Candidates were received by the directory
+	Announced time.Time
+	// Observer is the public key of the directory which observed Endpoint,
+	// when learned by gossip. Zero when observed by this directory's device.
+	Observer wgtypes.Key
+	// Record is the signed observation of Endpoint, when its observer signs records.
+	// Clients check it with Verify.
+	Record *Record
+}
+
+// newPeer copies the fields of p which may be disclosed according to d
+func newPeer(p wgtypes.Peer, d *Disclosure) Peer {
+	dp := Peer{
+		Status:            NoEndpoint,
+		PublicKey:         p.PublicKey,
+		Endpoint:          p.Endpoint,
+		LastHandshakeTime: p.LastHandshakeTime,
+	}
+	if d.private(p.PublicKey) {
+		dp.Endpoint = nil
+	}
+	if dp.Endpoint != nil {
+		dp.Status = Found
+	}
+	if d != nil && d.AllowedIPs {
+		dp.AllowedIPs = p.AllowedIPs
+	}
+	return dp
+}
+
+// expire removes the endpoint and candidates of p observed before cutoff.
+// A found peer left without either gets Status NoEndpoint.
+func (p *Peer) expire(cutoff time.Time) {
+	if p.Endpoint != nil && p.LastHandshakeTime.Before(cutoff) {
+		p.Endpoint, p.Observer, p.Record = nil, wgtypes.Key{}, nil
+	}
+	if len(p.Candidates) > 0 && p.Announced.Before(cutoff) {
+		p.Candidates, p.Announced = nil, time.Time{}
+	}
+	if p.Status == Found && p.Endpoint == nil && len(p.Candidates) == 0 {
+		p.Status = NoEndpoint
+	}
+}
+
 // PeerMap is a map of keys and peer information
 type PeerMap struct {
-	Peers map[wgtypes.Key]wgtypes.Peer
+	Peers map[wgtypes.Key]Peer
 }
 
 // Find peers by their public keys. Implements a net.RPC method.
+// Every requested key is present in the response,
+// with a Status reporting if the peer and its endpoint are known.
+//
+// With gossip enabled, a more recent endpoint from the gossip view takes precedence
+// over the device's and peers unknown to the device may be found.
+//
+// With a Policy, peers the caller may not find have Status NotVisible, see Server.SetPolicy.
+// The endpoints of Private peers are never returned, see Disclosure.
+// With a SigningKey on the Server, or a signed gossip record, the Endpoint is backed by a Record.
 func (s *RPC) Find(rq []wgtypes.Key, rs *PeerMap) error {
+	return s.find(rq, 0, rs)
+}
+
+// find is Find, without the endpoints and candidates observed longer than maxAge ago.
+// All are returned when maxAge is zero.
+func (s *RPC) find(rq []wgtypes.Key, maxAge time.Duration, rs *PeerMap) (err error) {
+	defer s.done("Find", time.Now(), &err)
+	caller, err := s.identity()
+	if err != nil {
+		return err
+	}
+	policy := s.currentPolicy()
 	dev, err := s.wgc.Device(s.device)
 	if err != nil {
 		return err
@@ -47,9 +435,90 @@ func (s *RPC) Find(rq []wgtypes.Key, rs *PeerMap) error {
 	for _, p := range dev.Peers {
 		all[p.PublicKey] = p
 	}
-	rs.Peers = make(map[wgtypes.Key]wgtypes.Peer)
+	now := time.Now()
+	rs.Peers = make(map[wgtypes.Key]Peer)
 	for _, k := range rq {
-		rs.Peers[k] = all[k]
+		if !policy.visible(caller, k) {
+			rs.Peers[k] = Peer{PublicKey: k, Status: NotVisible}
+			s.metrics.lookup(NotVisible)
+			s.debug("lookup", "key", k.String(), "status", NotVisible.String())
+			continue
+		}
+		dp := Peer{PublicKey: k}
+		p, known := all[k]
+		// Private peers neither get announced candidates nor gossiped endpoints
+		private := s.disclosure.private(k)
+		if known {
+			dp = newPeer(p, s.disclosure)
+			if r, ok := deviceRecord(dev, p); ok && s.signingKey != nil && dp.Endpoint != nil {
+				r.Sign(s.signingKey)
+				dp.Record = &r
+			}
+			if a, ok := s.announced.get(k, now, s.announceTTL); ok && !private {
+				dp.Candidates, dp.Announced = a.endpoints, a.time
+				dp.Status = Found
+			}
+		}
+		if r, ok := s.records.get(k, now); ok && !private && r.Observed.After(dp.LastHandshakeTime) {
+			dp.Endpoint, dp.LastHandshakeTime, dp.Observer = r.Endpoint, r.Observed, r.Observer
+			dp.Record = nil
+			if len(r.Signature) > 0 {
+				dp.Record = &r
+			}
+			dp.Status = Found
+		}
+		if maxAge > 0 {
+			dp.expire(now.Add(-maxAge))
+		}
+		rs.Peers[k] = dp
+		s.metrics.lookup(dp.Status)
+		s.debug("lookup", "key", k.String(), "status", dp.Status.String())
 	}
 	return nil
 }
+
+// ErrNegativeMaxAge is returned by FindDevice for a negative FindRequest.MaxAge
+var ErrNegativeMaxAge = errors.New("negative max age")
+
+// FindRequest is the argument of FindDevice
+type FindRequest struct {
+	// Device to find the Keys on, the device of the listener when empty
+	Device string
+	Keys   []wgtypes.Key
+	// MaxAge of the returned endpoints and candidates, all are returned when zero.
+	// Endpoints are aged by their LastHandshakeTime, candidates by their Announced time;
+	// endpoints without handshake are dropped.
+	MaxAge time.Duration
+}
+
+// FindDevice is Find, scoped to the device of rq. Implements a net.RPC method.
+// The device needs to be served by the Server, ErrUnknownDevice is returned otherwise.
+// With access control, the caller is authorized against the peers of that device.
+//
+// Endpoints and candidates older than rq.MaxAge are dropped,
+// found peers left without either have Status NoEndpoint.
+func (s *RPC) FindDevice(rq FindRequest, rs *PeerMap) error {
+	if rq.MaxAge < 0 {
+		err := ErrNegativeMaxAge
+		s.done("Find", time.Now(), &err)
+		return err
+	}
+	ds, err := s.forDevice(rq.Device)
+	if err != nil {
+		s.done("Find", time.Now(), &err)
+		return err
+	}
+	return ds.find(rq.Keys, rq.MaxAge, rs)
+}
+
+// forDevice returns the RPC for device
+func (s *RPC) forDevice(device string) (*RPC, error) {
+	switch {
+	case device == "" || device == s.device:
+		return s, nil
+	case s.scope == nil:
+		return nil, fmt.Errorf("%s: %w", device, ErrUnknownDevice)
+	default:
+		return s.scope(device)
+	}
+}
@@ -82,6 +82,11 @@ func init() {
 }
 
 func TestRPC_Find(t *testing.T) {
+	unknownKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownKey = unknownKey.PublicKey()
 	type fields struct {
 		device string
 		wgc    *wgctrl.Client
@@ -108,11 +113,11 @@ func TestRPC_Find(t *testing.T) {
 				rs: new(PeerMap),
 			},
 			want: PeerMap{
-				Peers: map[wgtypes.Key]wgtypes.Peer{
-					testKeys[0]: wgtypes.Peer{
-						PublicKey:       testKeys[0],
-						Endpoint:        testPeers[0].endpoint,
-						ProtocolVersion: 1,
+				Peers: map[wgtypes.Key]Peer{
+					testKeys[0]: Peer{
+						Status:    Found,
+						PublicKey: testKeys[0],
+						Endpoint:  testPeers[0].endpoint,
 					},
 				},
 			},
@@ -128,21 +133,40 @@ func TestRPC_Find(t *testing.T) {
 				rs: new(PeerMap),
 			},
 			want: PeerMap{
-				Peers: map[wgtypes.Key]wgtypes.Peer{
-					testKeys[0]: wgtypes.Peer{
-						PublicKey:       testKeys[0],
-						Endpoint:        testPeers[0].endpoint,
-						ProtocolVersion: 1,
+				Peers: map[wgtypes.Key]Peer{
+					testKeys[0]: Peer{
+						Status:    Found,
+						PublicKey: testKeys[0],
+						Endpoint:  testPeers[0].endpoint,
 					},
-					testKeys[1]: wgtypes.Peer{
-						PublicKey:       testKeys[1],
-						Endpoint:        testPeers[1].endpoint,
-						ProtocolVersion: 1,
+					testKeys[1]: Peer{
+						Status:    Found,
+						PublicKey: testKeys[1],
+						Endpoint:  testPeers[1].endpoint,
 					},
-					testKeys[2]: wgtypes.Peer{
-						PublicKey:       testKeys[2],
-						Endpoint:        testPeers[2].endpoint,
-						ProtocolVersion: 1,
+					testKeys[2]: Peer{
+						Status:    Found,
+						PublicKey: testKeys[2],
+						Endpoint:  testPeers[2].endpoint,
+					},
+				},
+			},
+		},
+		{
+			name: "not found",
+			fields: fields{
+				device: testDevice,
+				wgc:    wgc,
+			},
+			args: args{
+				rq: []wgtypes.Key{unknownKey},
+				rs: new(PeerMap),
+			},
+			want: PeerMap{
+				Peers: map[wgtypes.Key]Peer{
+					unknownKey: Peer{
+						Status:    NotFound,
+						PublicKey: unknownKey,
 					},
 				},
 			},
@@ -4,8 +4,11 @@ package server
 
 import (
 	"log"
+	"net"
 	"net/rpc"
+	"reflect"
 	"testing"
+	"time"
 
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
@@ -81,3 +84,216 @@ func TestRPC_error_Find(t *testing.T) {
 		})
 	}
 }
+
+func Test_newPeer(t *testing.T) {
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ipn, _ := net.ParseCIDR("10.0.0.1/32")
+	p := wgtypes.Peer{
+		PublicKey:         key.PublicKey(),
+		PresharedKey:      key,
+		Endpoint:          &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 123},
+		LastHandshakeTime: time.Unix(1567000000, 0),
+		ReceiveBytes:      1,
+		TransmitBytes:     2,
+		AllowedIPs:        []net.IPNet{*ipn},
+		ProtocolVersion:   1,
+	}
+	noEndpoint := p
+	noEndpoint.Endpoint = nil
+	tests := []struct {
+		name string
+		p    wgtypes.Peer
+		d    *Disclosure
+		want Peer
+	}{
+		{
+			name: "default",
+			p:    p,
+			want: Peer{
+				Status:            Found,
+				PublicKey:         p.PublicKey,
+				Endpoint:          p.Endpoint,
+				LastHandshakeTime: p.LastHandshakeTime,
+			},
+		},
+		{
+			name: "allowed IPs",
+			p:    p,
+			d:    &Disclosure{AllowedIPs: true},
+			want: Peer{
+				Status:            Found,
+				PublicKey:         p.PublicKey,
+				Endpoint:          p.Endpoint,
+				LastHandshakeTime: p.LastHandshakeTime,
+				AllowedIPs:        p.AllowedIPs,
+			},
+		},
+		{
+			name: "no endpoint",
+			p:    noEndpoint,
+			want: Peer{
+				Status:            NoEndpoint,
+				PublicKey:         p.PublicKey,
+				LastHandshakeTime: p.LastHandshakeTime,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newPeer(tt.p, tt.d); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newPeer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRPC_memory_Find(t *testing.T) {
+	keys := genKeys(t, 3)
+	ep := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 123}
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: keys[0], Endpoint: ep},
+		wgtypes.Peer{PublicKey: keys[1]},
+	)
+	tests := []struct {
+		name    string
+		device  string
+		rq      []wgtypes.Key
+		want    map[wgtypes.Key]Peer
+		wantErr bool
+	}{
+		{
+			name:   "found",
+			device: "wgtest",
+			rq:     keys[:1],
+			want: map[wgtypes.Key]Peer{
+				keys[0]: {Status: Found, PublicKey: keys[0], Endpoint: ep},
+			},
+		},
+		{
+			name:   "all states",
+			device: "wgtest",
+			rq:     keys,
+			want: map[wgtypes.Key]Peer{
+				keys[0]: {Status: Found, PublicKey: keys[0], Endpoint: ep},
+				keys[1]: {Status: NoEndpoint, PublicKey: keys[1]},
+				keys[2]: {Status: NotFound, PublicKey: keys[2]},
+			},
+		},
+		{
+			name:    "bogus device",
+			device:  "foo",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &RPC{
+				device: tt.device,
+				wgc:    m,
+			}
+			rs := new(PeerMap)
+			if err := s.Find(tt.rq, rs); (err != nil) != tt.wantErr {
+				t.Errorf("RPC.Find() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(rs.Peers, tt.want) {
+				t.Errorf("RPC.Find() = \n%v\n, want \n%v\n", rs.Peers, tt.want)
+			}
+		})
+	}
+}
+
+func TestRPC_Find_private(t *testing.T) {
+	keys := genKeys(t, 3)
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}
+	b := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 2}
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: keys[0], Endpoint: a, LastHandshakeTime: now.Add(-time.Minute)},
+		wgtypes.Peer{PublicKey: keys[1], Endpoint: a, LastHandshakeTime: now.Add(-time.Minute)},
+	)
+	s := &RPC{
+		device:      "wgtest",
+		wgc:         m,
+		disclosure:  &Disclosure{Private: keys[:1]},
+		caller:      &wgtypes.Peer{PublicKey: keys[2]},
+		announced:   new(announcements),
+		announceTTL: time.Minute,
+		records:     new(records),
+	}
+	s.announced.put(keys[0], Announcement{Endpoints: []*net.UDPAddr{b}}, now, time.Minute)
+
+	var rs []Record
+	rq := []Record{
+		{PublicKey: keys[0], Endpoint: b, Observed: now, Observer: keys[2]},
+		{PublicKey: keys[1], Endpoint: b, Observed: now, Observer: keys[2]},
+	}
+	if err := s.Gossip(rq, &rs); err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].PublicKey != keys[1] {
+		t.Errorf("RPC.Gossip() = %v, want the record of %s only", rs, keys[1])
+	}
+	if _, ok := s.records.get(keys[0], now); ok {
+		t.Error("RPC.Gossip() stored the record of a private peer")
+	}
+
+	pm := new(PeerMap)
+	if err := s.Find(keys[:2], pm); err != nil {
+		t.Fatal(err)
+	}
+	want := map[wgtypes.Key]Peer{
+		keys[0]: {Status: NoEndpoint, PublicKey: keys[0], LastHandshakeTime: now.Add(-time.Minute)},
+		keys[1]: {Status: Found, PublicKey: keys[1], Endpoint: b, LastHandshakeTime: now, Observer: keys[2]},
+	}
+	if !reflect.DeepEqual(pm.Peers, want) {
+		t.Errorf("RPC.Find() = \n%v\n, want \n%v\n", pm.Peers, want)
+	}
+}
+
+func TestRPC_FindDevice_maxAge(t *testing.T) {
+	keys := genKeys(t, 5)
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}
+	b := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 2}
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: keys[0], Endpoint: a, LastHandshakeTime: now.Add(-time.Minute)},
+		wgtypes.Peer{PublicKey: keys[1], Endpoint: a, LastHandshakeTime: now.Add(-time.Hour)},
+		wgtypes.Peer{PublicKey: keys[2], Endpoint: a},
+		wgtypes.Peer{PublicKey: keys[3], Endpoint: a, LastHandshakeTime: now.Add(-time.Hour)},
+	)
+	s := &RPC{
+		device:      "wgtest",
+		wgc:         m,
+		announced:   new(announcements),
+		announceTTL: time.Hour,
+		records:     new(records),
+	}
+	s.announced.put(keys[1], Announcement{Endpoints: []*net.UDPAddr{b}}, now.Add(-30*time.Minute), time.Hour)
+	s.announced.put(keys[3], Announcement{Endpoints: []*net.UDPAddr{b}}, now.Add(-time.Minute), time.Hour)
+	s.records.merge([]Record{{PublicKey: keys[4], Endpoint: b, Observed: now.Add(-30 * time.Minute)}}, now)
+
+	pm := new(PeerMap)
+	if err := s.FindDevice(FindRequest{Keys: keys, MaxAge: 10 * time.Minute}, pm); err != nil {
+		t.Fatal(err)
+	}
+	want := map[wgtypes.Key]Peer{
+		keys[0]: {Status: Found, PublicKey: keys[0], Endpoint: a, LastHandshakeTime: now.Add(-time.Minute)},
+		keys[1]: {Status: NoEndpoint, PublicKey: keys[1], LastHandshakeTime: now.Add(-time.Hour)},
+		keys[2]: {Status: NoEndpoint, PublicKey: keys[2]},
+		keys[3]: {Status: Found, PublicKey: keys[3], LastHandshakeTime: now.Add(-time.Hour), Candidates: []*net.UDPAddr{b}, Announced: now.Add(-time.Minute)},
+		keys[4]: {Status: NoEndpoint, PublicKey: keys[4], LastHandshakeTime: now.Add(-30 * time.Minute)},
+	}
+	if !reflect.DeepEqual(pm.Peers, want) {
+		t.Errorf("RPC.FindDevice() = \n%v\n, want \n%v\n", pm.Peers, want)
+	}
+
+	if err := s.FindDevice(FindRequest{Keys: keys, MaxAge: -time.Minute}, pm); err != ErrNegativeMaxAge {
+		t.Errorf("RPC.FindDevice() error = %v, want %v", err, ErrNegativeMaxAge)
+	}
+}
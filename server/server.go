@@ -2,75 +2,307 @@ package server
 
 import (
 	"context"
-	"log"
+	"crypto/ed25519"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Server implements a RPC server.
 type Server struct {
+	// Disclosure of optional peer information by Find.
+	// May be changed before ListenAndServe is called.
+	Disclosure Disclosure
+	// ACL restricts access to peers of the WireGuard device.
+	// Access control is disabled when nil.
+	// May be changed before ListenAndServe is called.
+	ACL *ACL
+	// Auth enables the authentication of callers by their WireGuard key, see RPC.Challenge.
+	// Authentication is disabled when nil.
+	// May be changed before ListenAndServe is called.
+	Auth *Auth
+	// SigningKey is the Ed25519 identity key the endpoint records observed by
+	// the devices of the Server are signed with, see Record.Sign.
+	// Records are not signed when nil.
+	// May be changed before ListenAndServe is called.
+	SigningKey ed25519.PrivateKey
+	// Trust list of the directories which records are accepted by gossip.
+	// Gossiped records are not verified when nil.
+	// May be changed before ListenAndServe is called.
+	Trust TrustList
+	// Backend used for the WireGuard queries.
+	// A wgctrl client is used when nil.
+	// May be changed before ListenAndServe is called.
+	Backend Backend
+	// AnnounceTTL is the time announced endpoints are served.
+	// DefaultAnnounceTTL is used when zero.
+	// May be changed before ListenAndServe is called.
+	AnnounceTTL time.Duration
+	// Gossip enables the Gossip RPC and the gossip view in Find.
+	// Records are exchanged by the gossip package.
+	// May be changed before ListenAndServe is called.
+	Gossip bool
+	// ReadHeaderTimeout and IdleTimeout of the HTTP listeners, see http.Server.
+	// May be changed before ListenAndServe is called.
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+
+	// Retry failed listeners with backoff, while the other listeners keep serving.
+	// ListenAndServe then only returns after Close or Shutdown,
+	// or when all listeners are permanently dead.
+	// When nil, a failed listener closes all listeners.
+	// May be changed before ListenAndServe is called.
+	Retry *Retry
+	// Logger receives the events of the server: RPC calls, lookups and the listener lifecycle.
+	// slog.Default is used when nil.
+	// May be changed before ListenAndServe is called.
+	Logger Logger
+	// StaleThreshold is the handshake age after which a peer is reported as stale
+	// in the metrics. DefaultStaleThreshold is used when zero.
+	// May be changed before ListenAndServe is called.
+	StaleThreshold time.Duration
+	// WatchInterval is the polling interval for address changes of the devices,
+	// used when a device was configured without addresses or by ConfigureAll,
+	// and address change notifications are not available on the system.
+	// DefaultWatchInterval is used when zero.
+	// May be changed before ListenAndServe is called.
+	WatchInterval time.Duration
+
+	// stores of the announcements and gossip view by device name, see deviceStores
+	stores   map[string]*stores
+	metrics  metrics
+	sessions sessions
+	policy   atomic.Pointer[Policy]
+
+	// ifaceIPs returns the addresses of a device interface, itfIPs when nil
+	ifaceIPs func(name string) ([]net.IP, error)
+	// addrEvents subscribes to address changes for watch, the system's addrEvents when nil
+	addrEvents func(ctx context.Context) (<-chan struct{}, error)
+
+	// discover serves all WireGuard devices on port, see ConfigureAll
+	discover bool
+	port     uint16
+	// follow is set when listeners follow the addresses of a device
+	follow bool
+
+	mu sync.Mutex
+	// devices served by the listeners, see AddDevice
+	devices   []*device
 	listeners []*http.Server
+	states    map[*http.Server]*listenerState
+	// dynamic is set when listeners are added by AddListener
+	dynamic bool
+	ec      chan served
+	quit    chan struct{}
+	running int
+	serving bool
+	closed  bool
+	cancel  context.CancelFunc
+}
+
+// announceTTL returns the configured or default AnnounceTTL
+func (s *Server) announceTTL() time.Duration {
+	if s.AnnounceTTL > 0 {
+		return s.AnnounceTTL
+	}
+	return DefaultAnnounceTTL
+}
+
+// served is the result of a listener's ListenAndServe
+type served struct {
+	l *http.Server
+	// bound is set when l served on its address before it stopped
+	bound bool
+	err   error
 }
 
-func (s *Server) listen() <-chan error {
-	ec := make(chan error)
+// listen starts all listeners, their results are send on the returned channel.
+// Listeners added later are started as well.
+// When the server was closed already, the retries of the listeners are stopped immediately.
+func (s *Server) listen() <-chan served {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serving = true
+	s.ec = make(chan served)
+	s.quit = make(chan struct{})
+	if s.closed {
+		close(s.quit)
+	}
 	for _, l := range s.listeners {
-		go func(l *http.Server) {
-			ec <- l.ListenAndServe()
-		}(l)
+		s.start(l)
+	}
+	return s.ec
+}
+
+// start serving on l, the result is send on s.ec.
+func (s *Server) start(l *http.Server) {
+	l.ReadHeaderTimeout = s.ReadHeaderTimeout
+	l.IdleTimeout = s.IdleTimeout
+	s.listenerState(l)
+	s.running++
+	go func(quit <-chan struct{}) {
+		s.ec <- s.serve(l, quit)
+	}(s.quit)
+}
+
+// stop prevents new listeners from being started and stops the address watcher.
+// It returns a copy of the current listeners.
+func (s *Server) stop() []*http.Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed && s.quit != nil {
+		close(s.quit)
 	}
-	return ec
+	s.closed = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+	return append([]*http.Server(nil), s.listeners...)
 }
 
 // Close the server now
-// All errors are send to "log" and only the last error is returned.
+// All errors are send to the Logger and returned as Errors.
 func (s *Server) Close() error {
-	var err error
-	for i, l := range s.listeners {
-		if err = l.Close(); err != nil {
-			log.Printf("Close %d on %s error: %v", i, l.Addr, err)
+	var errs Errors
+	for _, l := range s.stop() {
+		if err := l.Close(); err != nil {
+			s.logger().Error("listener close failed", "addr", l.Addr, "error", err)
+			errs = errs.add(l.Addr, err)
 		}
 	}
-	return err
+	return errs.err()
 }
 
 // Shutdown the server gracefully
-// All errors are send to "log" and only the last error is returned.
+// All errors are send to the Logger and returned as Errors.
 func (s *Server) Shutdown(ctx context.Context) error {
-	ec := make(chan error)
-	for _, l := range s.listeners {
-		go func(s *http.Server) {
-			ec <- s.Shutdown(ctx)
+	listeners := s.stop()
+	ec := make(chan served)
+	for _, l := range listeners {
+		go func(l *http.Server) {
+			ec <- served{l: l, err: l.Shutdown(ctx)}
 		}(l)
 	}
-	var err error
-	for i := 0; i < len(s.listeners); i++ {
-		err = <-ec
-		if err != nil {
-			log.Printf("Shutdown %d on %s error: %v", i, s.listeners[i].Addr, err)
+	var errs Errors
+	for range listeners {
+		r := <-ec
+		if r.err != nil {
+			s.logger().Error("listener shutdown failed", "addr", r.l.Addr, "error", r.err)
+			errs = errs.add(r.l.Addr, r.err)
 		}
 	}
-	return err
+	return errs.err()
 }
 
 // ListenAndServe the RPC servers on all configured addresses.
 // Blocks while there are open listeners.
 //
-// In case of a error other then http.ErrServerClosed on one of the listeners,
+// When a device was configured without addresses,
+// its listeners follow the addresses of the device: see WatchInterval.
+// ListenAndServe then blocks until Close or Shutdown is called,
+// even when the device has no addresses. The same applies after AddListener was called.
+// A listener that fails (permanently, with Retry) is retried on the next address change.
+//
+// With Retry, failed listeners are retried with backoff
+// and a permanently dead listener is removed.
+//
+// Otherwise, in case of a error other then http.ErrServerClosed on one of the listeners,
 // all remaining listeners are closed immediatly.
 //
-// All errors are send to "log" and only the last error is returned.
+// All errors are send to the Logger. The errors of the listeners are returned as Errors,
+// with the last error of each address. The error of an address is dropped when
+// a listener served on it again, like a dynamic listener that was added back.
+// Otherwise http.ErrServerClosed is returned, or nil when there were no listeners.
 func (s *Server) ListenAndServe() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.mu.Lock()
+	s.cancel = cancel
+	if s.closed {
+		cancel()
+	}
+	s.mu.Unlock()
 	ec := s.listen()
-	var err error
-	for i, l := range s.listeners {
-		err = <-ec
-		log.Printf("Listener %d on %s error: %v", i, l.Addr, err)
-		if err != http.ErrServerClosed {
-			if ce := s.Close(); ce != nil {
-				err = ce
-			}
+	defer func() {
+		s.mu.Lock()
+		s.serving = false
+		s.mu.Unlock()
+	}()
+	if s.follow {
+		go s.watch(ctx)
+	}
+
+	var (
+		errs  Errors
+		ran   bool
+		fatal bool
+	)
+	closed := ctx.Done()
+	for {
+		s.mu.Lock()
+		running, persistent := s.running, s.follow || s.dynamic
+		s.mu.Unlock()
+		if running == 0 && (!persistent || closed == nil) {
 			break
 		}
+		select {
+		case r := <-ec:
+			ran = true
+			if r.err == http.ErrServerClosed {
+				s.logger().Info("listener closed", "addr", r.l.Addr)
+				if r.bound {
+					errs = errs.remove(r.l.Addr)
+				}
+			} else {
+				s.logger().Error("listener failed", "addr", r.l.Addr, "error", r.err)
+				errs = errs.add(r.l.Addr, r.err)
+			}
+			if s.failed(r) && !fatal {
+				fatal = true
+				if ce, ok := s.Close().(Errors); ok {
+					for _, le := range ce {
+						errs = errs.add(le.Addr, le.Err)
+					}
+				}
+			}
+		case <-closed:
+			closed = nil
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if ran {
+		return http.ErrServerClosed
+	}
+	return nil
+}
+
+// failed handles the termination of a listener.
+// It returns true when all listeners need to be closed.
+func (s *Server) failed(r served) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	if r.err == http.ErrServerClosed {
+		return false
+	}
+	if s.follow || s.dynamic || s.Retry != nil {
+		s.removeListener(r.l)
+		return false
+	}
+	return true
+}
+
+// removeListener from s.listeners. s.mu must be held.
+func (s *Server) removeListener(l *http.Server) {
+	delete(s.states, l)
+	for i, x := range s.listeners {
+		if x == l {
+			s.listeners = append(s.listeners[:i:i], s.listeners[i+1:]...)
+			return
+		}
 	}
-	return err
 }
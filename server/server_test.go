@@ -65,8 +65,8 @@ func TestServer_listen(t *testing.T) {
 				if err := l.Close(); err != nil {
 					t.Fatal(err)
 				}
-				if err := <-ec; err != http.ErrServerClosed {
-					errs = append(errs, err)
+				if r := <-ec; r.err != http.ErrServerClosed {
+					errs = append(errs, r.err)
 				}
 			}
 			if (len(errs) != 0) != tt.wantErr {
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// signatureContext separates record signatures from other uses of the keys
+const signatureContext = "wire-directory record v1"
+
+// Record verification errors
+var (
+	ErrUnsigned     = errors.New("record not signed")
+	ErrUntrusted    = errors.New("observer not trusted")
+	ErrBadSignature = errors.New("invalid record signature")
+)
+
+// Sign r with key, the Ed25519 identity key of its Observer.
+// The signature covers all other fields of r.
+func (r *Record) Sign(key ed25519.PrivateKey) {
+	r.Signature = ed25519.Sign(key, r.message())
+}
+
+// message returns the signed representation of r
+func (r *Record) message() []byte {
+	var (
+		ip   []byte
+		port [2]byte
+		ts   [8]byte
+	)
+	if r.Endpoint != nil {
+		ip = r.Endpoint.IP.To16()
+		binary.BigEndian.PutUint16(port[:], uint16(r.Endpoint.Port))
+	}
+	binary.BigEndian.PutUint64(ts[:], uint64(r.Observed.UnixNano()))
+	var m []byte
+	for _, b := range [][]byte{[]byte(signatureContext), r.PublicKey[:], ip, port[:], ts[:], r.Observer[:]} {
+		// Length prefixed, so that the fields can not be shifted
+		m = append(m, byte(len(b)>>8), byte(len(b)))
+		m = append(m, b...)
+	}
+	return m
+}
+
+// signRecords returns rs signed with key, or rs when key is nil.
+// rs is not modified.
+func signRecords(rs []Record, key ed25519.PrivateKey) []Record {
+	if key == nil {
+		return rs
+	}
+	signed := make([]Record, len(rs))
+	for i, r := range rs {
+		r.Sign(key)
+		signed[i] = r
+	}
+	return signed
+}
+
+// TrustList binds the WireGuard public keys of observing directories
+// to the Ed25519 public keys they sign records with.
+type TrustList map[wgtypes.Key]ed25519.PublicKey
+
+// Verify that r is signed by its Observer, with the key bound to it by t.
+func (t TrustList) Verify(r Record) error {
+	if len(r.Signature) == 0 {
+		return ErrUnsigned
+	}
+	pub, ok := t[r.Observer]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUntrusted, r.Observer)
+	}
+	if len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, r.message(), r.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Records returns the records of rs which pass Verify, or rs when t is nil.
+// rs is not modified.
+func (t TrustList) Records(rs []Record) []Record {
+	if t == nil {
+		return rs
+	}
+	verified := make([]Record, 0, len(rs))
+	for _, r := range rs {
+		if t.Verify(r) == nil {
+			verified = append(verified, r)
+		}
+	}
+	return verified
+}
+
+// Verify that the Endpoint and LastHandshakeTime of p are backed by its Record,
+// signed by a directory in t. An old record can therefore not be passed off as a recent handshake.
+// ErrUnsigned is returned for peers without Record.
+func (p *Peer) Verify(t TrustList) error {
+	r := p.Record
+	if r == nil {
+		return ErrUnsigned
+	}
+	if r.PublicKey != p.PublicKey || !sameAddr(r.Endpoint, p.Endpoint) || !r.Observed.Equal(p.LastHandshakeTime) {
+		return fmt.Errorf("%w: record does not match the peer", ErrBadSignature)
+	}
+	return t.Verify(*r)
+}
+
+// sameAddr reports whether a and b are the same, non-nil address
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port
+}
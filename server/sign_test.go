@@ -0,0 +1,161 @@
+// +build unit
+
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func genSigningKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestRecord_Sign(t *testing.T) {
+	keys := genKeys(t, 3)
+	pub, priv := genSigningKey(t)
+	otherPub, _ := genSigningKey(t)
+	r := Record{
+		PublicKey: keys[0],
+		Endpoint:  &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 51820},
+		Observed:  time.Now(),
+		Observer:  keys[1],
+	}
+	trust := TrustList{keys[1]: pub, keys[2]: otherPub}
+	if err := trust.Verify(r); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Verify() error = %v, want %v", err, ErrUnsigned)
+	}
+	r.Sign(priv)
+	if err := trust.Verify(r); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+
+	// The record survives the JSON encoding of the HTTP APIs
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Record
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err = trust.Verify(decoded); err != nil {
+		t.Errorf("Verify() of decoded record error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(r *Record)
+		wantErr error
+	}{
+		{"peer", func(r *Record) { r.PublicKey = keys[2] }, ErrBadSignature},
+		{"endpoint", func(r *Record) { r.Endpoint = &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 51820} }, ErrBadSignature},
+		{"port", func(r *Record) { r.Endpoint = &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1} }, ErrBadSignature},
+		{"observed", func(r *Record) { r.Observed = r.Observed.Add(time.Second) }, ErrBadSignature},
+		{"other observer", func(r *Record) { r.Observer = keys[2] }, ErrBadSignature},
+		{"untrusted observer", func(r *Record) { r.Observer = keys[0] }, ErrUntrusted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := r
+			tt.modify(&m)
+			if err := trust.Verify(m); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if got := trust.Records([]Record{r, {PublicKey: keys[2]}}); len(got) != 1 {
+		t.Errorf("Records() = %v, want the signed record", got)
+	}
+	if got := TrustList(nil).Records([]Record{{PublicKey: keys[2]}}); len(got) != 1 {
+		t.Errorf("nil Records() = %v, want all records", got)
+	}
+}
+
+func TestRPC_Find_signed(t *testing.T) {
+	keys := genKeys(t, 4)
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1}
+	b := &net.UDPAddr{IP: net.ParseIP("192.168.0.2"), Port: 2}
+	pub, priv := genSigningKey(t)
+	otherPub, otherPriv := genSigningKey(t)
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: keys[0], Endpoint: a, LastHandshakeTime: now.Add(-time.Minute)},
+		wgtypes.Peer{PublicKey: keys[1], Endpoint: a, LastHandshakeTime: now.Add(-time.Minute)},
+	)
+	dev, err := m.Device("wgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust := TrustList{dev.PublicKey: pub, keys[2]: otherPub}
+	s := &RPC{
+		device:     "wgtest",
+		wgc:        m,
+		caller:     &wgtypes.Peer{PublicKey: keys[2]},
+		records:    new(records),
+		signingKey: priv,
+		trust:      trust,
+	}
+
+	signed := Record{PublicKey: keys[1], Endpoint: b, Observed: now, Observer: keys[2]}
+	signed.Sign(otherPriv)
+	rq := []Record{
+		signed,
+		// Not signed, dropped
+		{PublicKey: keys[3], Endpoint: b, Observed: now, Observer: keys[2]},
+	}
+	var rs []Record
+	if err = s.Gossip(rq, &rs); err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 2 {
+		t.Errorf("RPC.Gossip() = %v, want 2 records", rs)
+	}
+	for _, r := range rs {
+		if err = trust.Verify(r); err != nil {
+			t.Errorf("RPC.Gossip() record of %s: %v", r.PublicKey, err)
+		}
+	}
+
+	pm := new(PeerMap)
+	if err = s.Find(keys, pm); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys[:2] {
+		p := pm.Peers[k]
+		if err = p.Verify(trust); err != nil {
+			t.Errorf("Peer.Verify() of %s error = %v", k, err)
+		}
+	}
+	if got := pm.Peers[keys[1]].Endpoint; !sameAddr(got, b) {
+		t.Errorf("RPC.Find() endpoint = %v, want the gossiped %v", got, b)
+	}
+	if got := pm.Peers[keys[3]].Status; got != NotFound {
+		t.Errorf("RPC.Find() status = %v, want %v", got, NotFound)
+	}
+
+	// A directory rewriting the endpoint is detected
+	p := pm.Peers[keys[0]]
+	p.Endpoint = b
+	if err = p.Verify(trust); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Peer.Verify() error = %v, want %v", err, ErrBadSignature)
+	}
+	// As is an old record, replayed as a recent handshake
+	p = pm.Peers[keys[0]]
+	p.LastHandshakeTime = now
+	if err = p.Verify(trust); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Peer.Verify() of a replayed record error = %v, want %v", err, ErrBadSignature)
+	}
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DefaultWatchInterval is the polling interval for address changes of the devices.
+const DefaultWatchInterval = 10 * time.Second
+
+var errNotificationsClosed = errors.New("subscription closed")
+
+// watchInterval returns the configured or default WatchInterval
+func (s *Server) watchInterval() time.Duration {
+	if s.WatchInterval > 0 {
+		return s.WatchInterval
+	}
+	return DefaultWatchInterval
+}
+
+// watch the addresses of the devices and rebind the listeners on every change,
+// until ctx is done. Address change notifications of the system are used when available,
+// otherwise the addresses are polled every WatchInterval.
+func (s *Server) watch(ctx context.Context) {
+	var poll <-chan time.Time
+	startPolling := func(err error) {
+		s.logger().Warn("address notifications unavailable, polling", "error", err, "interval", s.watchInterval())
+		t := time.NewTicker(s.watchInterval())
+		poll = t.C
+		go func() {
+			<-ctx.Done()
+			t.Stop()
+		}()
+	}
+	subscribe := s.addrEvents
+	if subscribe == nil {
+		subscribe = addrEvents
+	}
+	events, err := subscribe(ctx)
+	if err != nil {
+		startPolling(err)
+	}
+
+	var last string
+	for {
+		if err := s.rebind(); err != nil && err.Error() != last {
+			s.logger().Warn("rebind failed", "error", err)
+			last = err.Error()
+		} else if err == nil {
+			last = ""
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-events:
+			if !ok && ctx.Err() == nil {
+				events = nil
+				startPolling(errNotificationsClosed)
+			}
+		case <-poll:
+		}
+	}
+}
+
+// wantedAddr is an address of a device its listeners follow
+type wantedAddr struct {
+	tca    net.TCPAddr
+	device string
+}
+
+// rebind the listeners to the current addresses of the devices.
+// Listeners on removed addresses, or of removed devices, are closed
+// and new addresses get a new listener. A device that does not exist has no addresses.
+// With ConfigureAll, the devices are discovered first.
+func (s *Server) rebind() error {
+	var errs []error
+	if s.discover {
+		if err := s.discoverDevices(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.mu.Lock()
+	var devices []device
+	for _, d := range s.devices {
+		if d.follow {
+			devices = append(devices, *d)
+		}
+	}
+	s.mu.Unlock()
+	want := make(map[string]wantedAddr)
+	for _, d := range devices {
+		tcas, err := tcpAddrs(d.name, d.port)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("addresses of %s: %w", d.name, err))
+			continue
+		}
+		for _, a := range tcas {
+			// An address shared by devices is served for the first one
+			if _, ok := want[a.String()]; !ok {
+				want[a.String()] = wantedAddr{a, d.name}
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	var keep []*http.Server
+	for _, l := range s.listeners {
+		if s.keepListener(l, want) {
+			keep = append(keep, l)
+			delete(want, l.Addr)
+			continue
+		}
+		device := listenerDevice(l)
+		delete(s.states, l)
+		s.logger().Info("address removed, closing listener", "addr", l.Addr, "device", device)
+		if cerr := l.Close(); cerr != nil {
+			s.logger().Error("listener close failed", "addr", l.Addr, "error", cerr)
+		}
+		if h, ok := l.Handler.(*handler); ok {
+			h.close()
+		}
+	}
+	s.listeners = keep
+
+	added := make([]wantedAddr, 0, len(want))
+	for _, a := range want {
+		added = append(added, a)
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].tca.String() < added[j].tca.String()
+	})
+	for _, a := range added {
+		hs, herr := httpServers(a.device, []net.TCPAddr{a.tca}, s)
+		if herr != nil {
+			return herr
+		}
+		s.logger().Info("address added, starting listener", "addr", hs[0].Addr, "device", a.device)
+		s.listeners = append(s.listeners, hs[0])
+		s.start(hs[0])
+	}
+	return errors.Join(errs...)
+}
+
+// keepListener reports whether l is kept by rebind: when it is added,
+// of a device with configured addresses, or on a wanted address of its device.
+// s.mu must be held.
+func (s *Server) keepListener(l *http.Server, want map[string]wantedAddr) bool {
+	if st, ok := s.states[l]; ok && st.added {
+		return true
+	}
+	device := listenerDevice(l)
+	d := s.findDevice(device)
+	if d == nil {
+		return false
+	}
+	if !d.follow {
+		return true
+	}
+	w, ok := want[l.Addr]
+	return ok && w.device == device
+}
+
+// listenerDevice returns the device served by l
+func listenerDevice(l *http.Server) string {
+	if h, ok := l.Handler.(*handler); ok {
+		return h.device
+	}
+	return ""
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// rtnetlink multicast groups, from linux/rtnetlink.h
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv6IfAddr = 0x100
+)
+
+// addrEvents subscribes to the address changes of all network interfaces, using rtnetlink.
+// The returned channel receives a value after one or more changes
+// and is closed when ctx is done or the subscription fails.
+func addrEvents(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr,
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// Reads time out, so that ctx is checked regularly.
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		defer syscall.Close(fd)
+		buf := make([]byte, os.Getpagesize())
+		for ctx.Err() == nil {
+			_, _, err := syscall.Recvfrom(fd, buf, 0)
+			switch err {
+			case syscall.EAGAIN, syscall.EINTR:
+				continue
+			case nil, syscall.ENOBUFS:
+				// ENOBUFS means notifications were lost, which is a change as well.
+			default:
+				return
+			}
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package server
+
+import (
+	"context"
+	"errors"
+)
+
+// addrEvents is not supported on this system, the addresses are polled instead.
+func addrEvents(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("not supported")
+}
@@ -0,0 +1,138 @@
+// +build unit
+
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+)
+
+func (s *Server) listenerAddrs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var addrs []string
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func waitAddrs(t *testing.T, s *Server, want int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := s.listenerAddrs()
+		if len(got) == want {
+			return got
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("listeners = %v, want %d", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitFree waits until the addresses can be bound again
+func waitFree(t *testing.T, addrs ...string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, addr := range addrs {
+		for {
+			ln, err := net.Listen("tcp", addr)
+			if err == nil {
+				ln.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s not free: %v", addr, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestServer_rebind(t *testing.T) {
+	s, err := Configure("foo", 9000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec := make(chan error, 1)
+	go func() {
+		ec <- s.ListenAndServe()
+	}()
+
+	// The device does not exist, ListenAndServe keeps waiting.
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-ec:
+		t.Fatalf("ListenAndServe() returned %v", err)
+	default:
+	}
+
+	// Addresses appear
+	s.mu.Lock()
+	s.devices[0].name = "lo"
+	s.mu.Unlock()
+	if err := s.rebind(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"127.0.0.1:9000", "[::1]:9000"}
+	got := waitAddrs(t, s, 2)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("listeners = %v, want %v", got, want)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	r, err := http.Get("http://127.0.0.1:9000/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	// Addresses disappear
+	s.mu.Lock()
+	s.devices[0].name = "foo"
+	s.mu.Unlock()
+	if err := s.rebind(); err == nil {
+		t.Error("rebind() expected error for missing device")
+	}
+	waitAddrs(t, s, 0)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-ec:
+		if err != nil && err != http.ErrServerClosed {
+			t.Errorf("ListenAndServe() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe() did not return after Close")
+	}
+}
+
+func Test_addrEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := addrEvents(ctx)
+	if err != nil {
+		t.Skip(err)
+	}
+	cancel()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("events not closed after cancel")
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Reflection of the calling peer, as observed by the directory.
+// Combining the reflections of several directories allows a peer
+// behind NAT to discover its public endpoint.
+type Reflection struct {
+	// Known reports if the caller is a peer of the directory's device
+	Known bool
+	// PublicKey of the calling peer
+	PublicKey wgtypes.Key
+	// Endpoint of the calling peer, as seen by the directory's WireGuard device
+	Endpoint          *net.UDPAddr
+	LastHandshakeTime time.Time
+	// RemoteAddr of the RPC connection
+	RemoteAddr *net.TCPAddr
+}
+
+// WhoAmI reflects the WireGuard endpoint and RPC remote address of the caller.
+// Implements a net.RPC method.
+//
+// The caller is identified by access control or authentication. When both are disabled,
+// the peer is looked up by the remote address of the RPC connection in the allowed IPs of the device.
+func (s *RPC) WhoAmI(rq struct{}, rs *Reflection) (err error) {
+	defer s.done("WhoAmI", time.Now(), &err)
+	caller, err := s.identity()
+	if err != nil {
+		return err
+	}
+	rs.RemoteAddr = s.remote
+	dev, err := s.wgc.Device(s.device)
+	if err != nil {
+		return err
+	}
+	var (
+		p  wgtypes.Peer
+		ok bool
+	)
+	switch {
+	case caller != nil:
+		p, ok = peerByKey(dev.Peers, caller.PublicKey)
+	case s.remote != nil:
+		p, ok = peerByIP(dev.Peers, s.remote.IP, s.acl != nil && s.acl.Networks)
+	}
+	if !ok {
+		return nil
+	}
+	rs.Known = true
+	rs.PublicKey = p.PublicKey
+	rs.Endpoint = p.Endpoint
+	rs.LastHandshakeTime = p.LastHandshakeTime
+	return nil
+}
@@ -0,0 +1,79 @@
+// +build unit
+
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRPC_WhoAmI(t *testing.T) {
+	keys := genKeys(t, 2)
+	now := time.Now()
+	ep := &net.UDPAddr{IP: net.ParseIP("89.43.12.33"), Port: 51820}
+	_, ipn0, _ := net.ParseCIDR("10.0.0.1/32")
+	_, ipn1, _ := net.ParseCIDR("10.0.0.2/32")
+	m := NewMemoryBackend()
+	m.SetPeers("wgtest",
+		wgtypes.Peer{PublicKey: keys[0], Endpoint: ep, LastHandshakeTime: now, AllowedIPs: []net.IPNet{*ipn0}},
+		wgtypes.Peer{PublicKey: keys[1], AllowedIPs: []net.IPNet{*ipn1}},
+	)
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	tests := []struct {
+		name    string
+		caller  *wgtypes.Peer
+		remote  *net.TCPAddr
+		want    Reflection
+		wantErr bool
+	}{
+		{
+			name:   "by remote address",
+			remote: remote,
+			want: Reflection{
+				Known:             true,
+				PublicKey:         keys[0],
+				Endpoint:          ep,
+				LastHandshakeTime: now,
+				RemoteAddr:        remote,
+			},
+		},
+		{
+			name:   "by caller",
+			caller: &wgtypes.Peer{PublicKey: keys[1]},
+			remote: remote,
+			want: Reflection{
+				Known:      true,
+				PublicKey:  keys[1],
+				RemoteAddr: remote,
+			},
+		},
+		{
+			name:   "unknown",
+			remote: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1234},
+			want: Reflection{
+				RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 1234},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &RPC{
+				device: "wgtest",
+				wgc:    m,
+				caller: tt.caller,
+				remote: tt.remote,
+			}
+			var got Reflection
+			if err := s.WhoAmI(struct{}{}, &got); (err != nil) != tt.wantErr {
+				t.Errorf("RPC.WhoAmI() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RPC.WhoAmI() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}